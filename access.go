@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// AccessRule allows or denies requests by the IP address they come from.
+// Rules apply to every request, unless they are scoped to a path, a user
+// directory, or requests running CGI scripts.
+type AccessRule struct {
+	Path  string // Requests for this path or anything under it
+	User  string // Requests for this user's directory
+	CGI   bool   // Only requests running CGI scripts
+	Allow []string
+	Deny  []string
+
+	allow, deny []*net.IPNet
+}
+
+func (rule *AccessRule) String() string {
+	var scope []string
+	if rule.Path != "" {
+		scope = append(scope, "path "+rule.Path)
+	}
+	if rule.User != "" {
+		scope = append(scope, "user "+rule.User)
+	}
+	if rule.CGI {
+		scope = append(scope, "CGI")
+	}
+	if len(scope) == 0 {
+		return "[[access]] rule for all requests"
+	}
+	return "[[access]] rule for " + strings.Join(scope, ", ")
+}
+
+func (rule *AccessRule) validate() (err error) {
+	if rule.Path != "" && !strings.HasPrefix(rule.Path, "/") {
+		return fmt.Errorf("[[access]] path %q must start with /", rule.Path)
+	}
+	if rule.allow, err = parseCIDRs(rule.Allow); err != nil {
+		return fmt.Errorf("%s: %w", rule, err)
+	}
+	if rule.deny, err = parseCIDRs(rule.Deny); err != nil {
+		return fmt.Errorf("%s: %w", rule, err)
+	}
+	return nil
+}
+
+// parseCIDRs parses a list of networks in CIDR notation. Plain IP addresses
+// are taken as networks of just that address.
+func parseCIDRs(entries []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, network)
+	}
+	return nets, nil
+}
+
+// check returns why ip is denied by the rule, if it is
+func (rule *AccessRule) check(ip net.IP) string {
+	for _, network := range rule.deny {
+		if network.Contains(ip) {
+			return fmt.Sprintf("%s is in denied network %s of %s", ip, network, rule)
+		}
+	}
+	if len(rule.allow) == 0 {
+		return ""
+	}
+	for _, network := range rule.allow {
+		if network.Contains(ip) {
+			return ""
+		}
+	}
+	return fmt.Sprintf("%s is not in an allowed network of %s", ip, rule)
+}
+
+// accessDenied checks the remote address of the request against the access
+// rules scoped to it, and returns why it is denied, if it is. Rules for CGI
+// are only checked when cgi is true, once the request is known to run a
+// script. Every rule that applies must allow the request. Once resolvePath
+// has found the .spsrv files for the request, their rules are checked too.
+func accessDenied(conf *Config, req *Request, cgi bool) string {
+	rules := conf.Access
+	if conf.local != nil {
+		rules = append(rules[:len(rules):len(rules)], conf.local.Access...)
+	}
+	if len(rules) == 0 {
+		return ""
+	}
+	ip := net.ParseIP(remoteIP(*req.netConn))
+	if ip == nil {
+		return "unable to parse remote address"
+	}
+	user := requestUser(conf, req)
+	for i := range rules {
+		rule := &rules[i]
+		if rule.CGI != cgi {
+			continue
+		}
+		if _, ok := matchMount(rule.Path, req.path); rule.Path != "" && !ok {
+			continue
+		}
+		if rule.User != "" && rule.User != user {
+			continue
+		}
+		if reason := rule.check(ip); reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
+
+// requestUser returns the user whose directory the request is for, if any,
+// before resolvePath has run.
+func requestUser(conf *Config, req *Request) string {
+	if req.vhost != "" {
+		return req.vhost
+	}
+	if conf.UserDirEnable && strings.HasPrefix(req.path, "/~") {
+		return strings.SplitN(req.path[2:], "/", 2)[0]
+	}
+	return ""
+}
+
+// denyAccess logs why a request is denied and sends a 4 response
+func denyAccess(req *Request, reason string) {
+	log.Println("Denying access: " + reason)
+	sendResponseHeader(req.conn, statusClientError, "Access denied")
+}
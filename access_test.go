@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAccessPathScope(t *testing.T) {
+	conf := testConfig(t)
+	conf.Access = []AccessRule{{Path: "/private/", Deny: []string{"127.0.0.0/8"}}}
+	if err := conf.validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"private", "public"} {
+		if err := os.Mkdir(filepath.Join(conf.RootDir, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(conf.RootDir, dir, "s.txt"), []byte("secret\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, path := range []string{
+		"/private/s.txt",
+		"/private/",
+		"/private",
+		"//private/s.txt",
+		"/./private/s.txt",
+		"/public/../private/s.txt",
+		"/private//s.txt",
+		"/private/./s.txt",
+		"private/s.txt",
+		"/%2Fprivate/s.txt",
+	} {
+		if response := doRequest(t, conf, "localhost "+path+" 0", ""); response[0] != '4' {
+			t.Errorf("%s: got response %q, want it denied", path, response)
+		}
+	}
+	if response := doRequest(t, conf, "localhost //public/./s.txt 0", ""); response != "2 text/plain; charset=utf-8\r\nsecret\n" {
+		t.Errorf("got response %q for //public/./s.txt", response)
+	}
+}
+
+func TestCleanRequestPath(t *testing.T) {
+	for path, want := range map[string]string{
+		"":           "",
+		"/":          "/",
+		"//":         "/",
+		"/a/b":       "/a/b",
+		"/a/b/":      "/a/b/",
+		"//a//b//":   "/a/b/",
+		"/./a/./b":   "/a/b",
+		"/a/.":       "/a",
+		"a/b":        "/a/b",
+		"/~user//x/": "/~user/x/",
+	} {
+		if got := cleanRequestPath(path); got != want {
+			t.Errorf("cleanRequestPath(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
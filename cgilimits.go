@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// CGILimits restricts the resources CGI processes may use. Zero means no
+// limit, except for Timeout which must be set.
+type CGILimits struct {
+	Timeout    int   // Wall clock time in seconds
+	CPUTime    int   // CPU time in seconds
+	Memory     int64 // Address space in bytes
+	OpenFiles  int
+	Processes  int   // Processes of the user running the script
+	OutputSize int64 // Bytes
+}
+
+// merge returns l with the non-zero values of override on top
+func (l CGILimits) merge(override CGILimits) CGILimits {
+	if override.Timeout != 0 {
+		l.Timeout = override.Timeout
+	}
+	if override.CPUTime != 0 {
+		l.CPUTime = override.CPUTime
+	}
+	if override.Memory != 0 {
+		l.Memory = override.Memory
+	}
+	if override.OpenFiles != 0 {
+		l.OpenFiles = override.OpenFiles
+	}
+	if override.Processes != 0 {
+		l.Processes = override.Processes
+	}
+	if override.OutputSize != 0 {
+		l.OutputSize = override.OutputSize
+	}
+	return l
+}
+
+func (l CGILimits) validate(name string) error {
+	if l.Timeout < 0 || l.CPUTime < 0 || l.Memory < 0 || l.OpenFiles < 0 || l.Processes < 0 || l.OutputSize < 0 {
+		return fmt.Errorf("%s must not have negative values", name)
+	}
+	return nil
+}
+
+// Rlimits are applied by re-executing spsrv with this as the first argument,
+// which sets them on itself before executing the script.
+const cgiHelperArg = "--run-cgi-with-limits"
+
+// rlimits returns the limits in the form passed to the helper, which is empty
+// if there is nothing to set.
+func (l CGILimits) rlimits() string {
+	var fields []string
+	if l.CPUTime > 0 {
+		fields = append(fields, fmt.Sprintf("%d=%d", syscall.RLIMIT_CPU, l.CPUTime))
+	}
+	if l.Memory > 0 {
+		fields = append(fields, fmt.Sprintf("%d=%d", syscall.RLIMIT_AS, l.Memory))
+	}
+	if l.OpenFiles > 0 {
+		fields = append(fields, fmt.Sprintf("%d=%d", syscall.RLIMIT_NOFILE, l.OpenFiles))
+	}
+	if l.Processes > 0 {
+		fields = append(fields, fmt.Sprintf("%d=%d", rlimitNproc, l.Processes))
+	}
+	return strings.Join(fields, ",")
+}
+
+// cgiCommand returns the command running program with the limits applied.
+// The process is the leader of a new process group, so that it can be killed
+// along with any process it started.
+func cgiCommand(l CGILimits, program string, args ...string) *exec.Cmd {
+	var cmd *exec.Cmd
+	rlimits := l.rlimits()
+	self, err := os.Executable()
+	if rlimits == "" || err != nil {
+		cmd = exec.Command(program, args...)
+	} else {
+		cmd = exec.Command(self, append([]string{cgiHelperArg, rlimits, program}, args...)...)
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return cmd
+}
+
+// runCGIHelper sets the rlimits given in args[0], then executes the script
+// in args[1] with the arguments after it. It only returns on errors.
+func runCGIHelper(args []string) error {
+	if len(args) < 2 {
+		return errors.New("missing arguments")
+	}
+	for _, field := range strings.Split(args[0], ",") {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid limit %q", field)
+		}
+		resource, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return fmt.Errorf("invalid limit %q", field)
+		}
+		value, err := strconv.ParseUint(parts[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid limit %q", field)
+		}
+		rlim := &syscall.Rlimit{Cur: value, Max: value}
+		if resource == syscall.RLIMIT_CPU {
+			// Leave a second between SIGXCPU and SIGKILL
+			rlim.Max++
+		}
+		if err := syscall.Setrlimit(resource, rlim); err != nil {
+			return fmt.Errorf("unable to set limit %q: %w", field, err)
+		}
+	}
+	return syscall.Exec(args[1], args[1:], os.Environ())
+}
+
+// cgiProcess kills the process group of a CGI process once, remembering why.
+type cgiProcess struct {
+	cmd    *exec.Cmd
+	mu     sync.Mutex
+	killed bool
+	reason string
+}
+
+// kill kills the process group. The reason is the limit that was exceeded,
+// or empty if it is being killed for another reason.
+func (p *cgiProcess) kill(reason string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.killed {
+		return
+	}
+	p.killed = true
+	p.reason = reason
+	killProcessGroup(p.cmd.Process.Pid)
+}
+
+// killedFor returns the limit the process was killed for exceeding, if any
+func (p *cgiProcess) killedFor() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.reason
+}
+
+func (p *cgiProcess) wasKilled() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.killed
+}
+
+var errOutputLimit = errors.New("output size limit exceeded")
+
+// limitWriter calls exceeded instead of writing past limit bytes. A limit of
+// zero means no limit.
+type limitWriter struct {
+	w        io.Writer
+	n, limit int64
+	exceeded func()
+}
+
+func (lw *limitWriter) Write(b []byte) (int, error) {
+	if lw.limit > 0 && lw.n+int64(len(b)) > lw.limit {
+		lw.exceeded()
+		return 0, errOutputLimit
+	}
+	n, err := lw.w.Write(b)
+	lw.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// CGIRule makes the files it matches run as CGI scripts. Exactly one of
+// Prefix, Glob and Regex is set, and is matched against the path of the file
+// relative to the root or user directory, such as cgi/app.sh.
+type CGIRule struct {
+	Prefix string
+	// Globs without a slash are matched against the file name only
+	Glob  string
+	Regex string
+
+	// Interpreter runs the scripts, which then don't need to be executable.
+	// It takes precedence over the [interpreters] table.
+	Interpreter string
+	// UserAllowed lets the rule match scripts in user directories, if
+	// UserCGIEnable is set too
+	UserAllowed bool
+	// Limits for this rule, on top of CGILimits
+	CGILimits
+
+	prefix  bool
+	regex   *regexp.Regexp
+	limits  CGILimits
+	command []string // Interpreter, looked up in PATH and split into fields
+}
+
+func (rule *CGIRule) String() string {
+	switch {
+	case rule.regex != nil:
+		return "regex " + rule.Regex
+	case rule.Glob != "":
+		return "glob " + rule.Glob
+	default:
+		return fmt.Sprintf("prefix %q", rule.Prefix)
+	}
+}
+
+// patterns returns the number of Prefix, Glob and Regex that are set
+func (rule *CGIRule) patterns() int {
+	n := 0
+	for _, pattern := range []string{rule.Prefix, rule.Glob, rule.Regex} {
+		if pattern != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// compile checks the rule and prepares it for matching, with base being the
+// limits it is on top of. An empty rule matches everything.
+func (rule *CGIRule) compile(base CGILimits) error {
+	rule.prefix, rule.regex = false, nil
+	switch {
+	case rule.Regex != "":
+		regex, err := regexp.Compile(rule.Regex)
+		if err != nil {
+			return fmt.Errorf("invalid [[cgi]] regex %q: %w", rule.Regex, err)
+		}
+		rule.regex = regex
+	case rule.Glob != "":
+		if _, err := path.Match(rule.Glob, ""); err != nil {
+			return fmt.Errorf("invalid [[cgi]] glob %q: %w", rule.Glob, err)
+		}
+	default:
+		rule.prefix = true
+	}
+
+	if err := rule.CGILimits.validate(fmt.Sprintf("[[cgi]] rule for %s", rule)); err != nil {
+		return err
+	}
+	rule.limits = base.merge(rule.CGILimits)
+
+	rule.command = nil
+	if rule.Interpreter != "" {
+		command, err := parseInterpreter(rule.Interpreter)
+		if err != nil {
+			return fmt.Errorf("interpreter for [[cgi]] rule for %s: %w", rule, err)
+		}
+		rule.command = command
+	}
+	return nil
+}
+
+// parseInterpreter splits an interpreter command into its fields, with the
+// program looked up in PATH.
+func parseInterpreter(interpreter string) ([]string, error) {
+	fields := strings.Fields(interpreter)
+	if len(fields) == 0 {
+		return nil, errors.New("interpreter must not be empty")
+	}
+	program, err := exec.LookPath(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{program}, fields[1:]...), nil
+}
+
+// compileInterpreters looks up the commands of the [interpreters] table,
+// keyed by extensions including the leading dot.
+func (conf *Config) compileInterpreters() error {
+	conf.interpreters = make(map[string][]string)
+	for ext, interpreter := range conf.Interpreters {
+		command, err := parseInterpreter(interpreter)
+		if err != nil {
+			return fmt.Errorf("interpreter for %q: %w", ext, err)
+		}
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		conf.interpreters[ext] = command
+	}
+	return nil
+}
+
+// cgiCommandFor returns the interpreter command to run script with, or nil if
+// it is to be executed directly.
+func (conf *Config) cgiCommandFor(rule *CGIRule, script string) []string {
+	if rule.command != nil {
+		return rule.command
+	}
+	return conf.interpreters[path.Ext(script)]
+}
+
+func (rule *CGIRule) match(script string) bool {
+	switch {
+	case rule.prefix:
+		return strings.HasPrefix(script, rule.Prefix)
+	case rule.regex != nil:
+		return rule.regex.MatchString(script)
+	case strings.Contains(rule.Glob, "/"):
+		ok, _ := path.Match(rule.Glob, script)
+		return ok
+	default:
+		ok, _ := path.Match(rule.Glob, path.Base(script))
+		return ok
+	}
+}
+
+// compileCGIRules builds the list of CGI rules from the [[cgi]] tables,
+// followed by CGIPaths.
+func (conf *Config) compileCGIRules() error {
+	conf.cgiRules = nil
+	for i := range conf.CGI {
+		rule := &conf.CGI[i]
+		if rule.patterns() != 1 {
+			return errors.New("every [[cgi]] rule must set exactly one of prefix, glob and regex")
+		}
+		if err := rule.compile(conf.CGILimits); err != nil {
+			return err
+		}
+		conf.cgiRules = append(conf.cgiRules, rule)
+	}
+	for _, cgiPath := range conf.CGIPaths {
+		rule := &CGIRule{Prefix: cgiPath, UserAllowed: true, CGILimits: conf.CGIPathLimits[cgiPath]}
+		if err := rule.compile(conf.CGILimits); err != nil {
+			return err
+		}
+		conf.cgiRules = append(conf.cgiRules, rule)
+	}
+	return nil
+}
+
+// cgiRuleFor returns the first rule matching script, if any
+func (conf *Config) cgiRuleFor(script string) *CGIRule {
+	for _, rule := range conf.cgiRules {
+		if rule.match(script) {
+			return rule
+		}
+	}
+	return nil
+}
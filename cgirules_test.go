@@ -0,0 +1,163 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCGIRuleFor(t *testing.T) {
+	conf := testConfig(t)
+	conf.CGIPaths = []string{"cgi-bin/"}
+	conf.CGI = []CGIRule{
+		{Prefix: "cgi/"},
+		{Glob: "*.cgi", UserAllowed: true},
+		{Glob: "apps/*/run"},
+		{Regex: `^bin/.*\.py$`},
+		// Never reached for cgi/ and *.cgi
+		{Glob: "*"},
+	}
+	if err := conf.validate(); err != nil {
+		t.Fatal(err)
+	}
+	for script, want := range map[string]string{
+		// The first rule that matches wins
+		"cgi/app.cgi":     `prefix "cgi/"`,
+		"cgi/app.sh":      `prefix "cgi/"`,
+		"cgi-bin/app.cgi": "glob *.cgi",
+		// Globs without a slash only see the file name
+		"app.cgi":       "glob *.cgi",
+		"a/b/c/app.cgi": "glob *.cgi",
+		"app.cgi/x":     "glob *",
+		// and those with one the whole path
+		"apps/wiki/run":     "glob apps/*/run",
+		"apps/wiki/sub/run": "glob *",
+		"other/apps/a/run":  "glob *",
+		"bin/a/b.py":        `regex ^bin/.*\.py$`,
+		"x/bin/a.py":        "glob *",
+	} {
+		rule := conf.cgiRuleFor(script)
+		if rule == nil {
+			t.Errorf("no rule for %s, want %s", script, want)
+		} else if rule.String() != want {
+			t.Errorf("got rule for %s for %s, want %s", rule, script, want)
+		}
+	}
+
+	// Without the catch-all, CGIPaths come last
+	conf.CGI = conf.CGI[:4]
+	if err := conf.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if rule := conf.cgiRuleFor("cgi-bin/app.sh"); rule == nil || rule.String() != `prefix "cgi-bin/"` {
+		t.Errorf("got rule %v for cgi-bin/app.sh, want the one from CGIPaths", rule)
+	}
+	if rule := conf.cgiRuleFor("static/page.gmi"); rule != nil {
+		t.Errorf("got rule for %s for static/page.gmi, want none", rule)
+	}
+
+	for script, want := range map[string]bool{
+		"cgi/app.sh":     false,
+		"app.cgi":        true,
+		"cgi-bin/app.sh": true,
+	} {
+		if rule := conf.cgiRuleFor(script); rule.UserAllowed != want {
+			t.Errorf("got userAllowed=%v for %s, want %v", rule.UserAllowed, script, want)
+		}
+	}
+}
+
+func TestCGIRuleInvalid(t *testing.T) {
+	for _, rule := range []CGIRule{
+		{},
+		{Prefix: "cgi/", Glob: "*.cgi"},
+		{Glob: "[a-"},
+		{Regex: "("},
+		{Glob: "*.py", Interpreter: "no-such-interpreter-for-spsrv"},
+	} {
+		conf := testConfig(t)
+		conf.CGI = []CGIRule{rule}
+		if err := conf.validate(); err == nil {
+			t.Errorf("rule %+v was accepted", rule)
+		}
+	}
+}
+
+func TestCGICommandFor(t *testing.T) {
+	conf := testConfig(t)
+	conf.Interpreters = map[string]string{".sh": "sh -e", "pl": "perl"}
+	conf.CGI = []CGIRule{
+		{Prefix: "cgi/", Interpreter: "bash"},
+		{Prefix: "other/"},
+	}
+	if err := conf.validate(); err != nil {
+		t.Fatal(err)
+	}
+	for script, want := range map[string]string{
+		// The rule takes precedence over the table
+		"cgi/app.sh": "bash",
+		"cgi/app":    "bash",
+		"other/a.sh": "sh -e",
+		// Extensions in the table may leave out the dot
+		"other/a.pl": "perl",
+		// Anything else is executed directly
+		"other/a.py": "",
+		"other/sh":   "",
+	} {
+		command := conf.cgiCommandFor(conf.cgiRuleFor(script), script)
+		got := ""
+		if command != nil {
+			got = filepath.Base(command[0])
+			if len(command) > 1 {
+				got += " " + strings.Join(command[1:], " ")
+			}
+		}
+		if got != want {
+			t.Errorf("got command %q for %s, want %q", got, script, want)
+		}
+	}
+}
+
+func TestCGIInterpreter(t *testing.T) {
+	conf := testConfig(t)
+	conf.CGI = []CGIRule{{Prefix: "rule/", Interpreter: "sh"}}
+	conf.CGIPaths = []string{"table/", "plain/"}
+	// A script run by the table would fail
+	conf.Interpreters = map[string]string{".sh": "false"}
+	script := "#!/bin/sh\nprintf '2 text/plain\\r\\nran %s' \"$SCRIPT_NAME\"\n"
+	for name, mode := range map[string]os.FileMode{
+		"rule/script.sh":  0644,
+		"table/script.sh": 0644,
+		"plain/script":    0644,
+		"plain/exec":      0755,
+	} {
+		path := filepath.Join(conf.RootDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(script), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := conf.validate(); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		path, response string
+	}{
+		// Not executable, but run by the interpreter of the rule over the
+		// one of the table
+		{"/rule/script.sh", "2 text/plain\r\nran /rule/script.sh"},
+		// Run by the interpreter of the table
+		{"/table/script.sh", "5 CGI error\r\n"},
+		// Without an interpreter, only executable files are run
+		{"/plain/exec", "2 text/plain\r\nran /plain/exec"},
+		{"/plain/script", "2 text/plain; charset=utf-8\r\n" + script},
+	} {
+		if response := doRequest(t, conf, "localhost "+test.path+" 0", ""); response != test.response {
+			t.Errorf("%s: got response %q, want %q", test.path, response, test.response)
+		}
+	}
+}
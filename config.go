@@ -1,8 +1,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
 	"strings"
 
@@ -11,44 +13,112 @@ import (
 
 type Config struct {
 	Port           int
+	Listen         []string
 	Hostname       string
 	RootDir        string
 	UserDirEnable  bool
 	UserDir        string
 	UserSubdomains bool
+	IndexFile      string // Served for requests for a directory
 	DirlistEnable  bool
 	DirlistReverse bool
 	DirlistSort    string
 	DirlistTitles  bool
 	CGIPaths       []string
 	UserCGIEnable  bool
+	CGILimits      CGILimits
+	CGIPathLimits  map[string]CGILimits
+	CGI            []CGIRule
+	Interpreters   map[string]string // Extension to command running scripts with it
+	MIMETypes      map[string]string // Extension to MIME type of static files
+	Lang           string            // Of gemtext files, unless overridden
+	Charset        string
+	InferLang      bool // Take the lang from file names like index.de.gmi
+	Directories    map[string]DirConfig
+	SCGI           []SCGIRoute
+	FastCGI        []FastCGIRoute
+	Proxy          []ProxyRoute
+	Access         []AccessRule
+	Redirect       []RedirectRule
+	DrainTimeout   int
+	User           string
+	Group          string
+	DefaultVhost   string
+
+	// Limits on requests. RequestTimeout, MaxRequestLength and WriteTimeout
+	// are only taken from the top level, as vhosts are picked after the
+	// request line is read.
+	RequestTimeout   int   // Seconds to wait for the request line
+	MaxRequestLength int   // Bytes, not counting CRLF
+	MaxDataSize      int64 // Bytes, 0 for no limit
+	DataTimeout      int   // Seconds to wait for the whole data block
+	WriteTimeout     int   // Seconds a write to the client may block for
+
+	// Limits on clients, 0 for no limit. The rates are requests per second
+	// from each remote IP.
+	MaxConnections      int
+	MaxConnectionsPerIP int
+	RateLimit           float64
+	RateBurst           int
+	CGIRateLimit        float64
+	CGIRateBurst        int
+
+	// ProxyProtocol expects connections to start with a PROXY protocol
+	// header, which is only accepted from ProxyProtocolTrusted networks
+	ProxyProtocol        bool
+	ProxyProtocolTrusted []string
+
+	// Vhosts are built from the [[vhost]] tables. Each one starts off as a
+	// copy of the top level config with the values from its table on top,
+	// apart from the routes to backends and upstreams, and the redirects.
+	Vhosts []*Config `toml:"-"`
+
+	// cgiRules are the [[cgi]] rules followed by CGIPaths, checked in order
+	cgiRules     []*CGIRule
+	interpreters map[string][]string
+	proxyTrusted []*net.IPNet
+	mimeTypes    map[string]string
+
+	// local holds the options of .spsrv files that have no counterpart
+	// above, on the copy of the config made for a request under them
+	local *LocalConfig
 }
 
 var defaultConf = &Config{
 	Port:           300,
 	Hostname:       "localhost",
 	RootDir:        "/var/spartan/",
+	IndexFile:      "index.gmi",
 	DirlistEnable:  true,
 	DirlistReverse: false,
 	DirlistSort:    "name",
 	DirlistTitles:  true,
+	Lang:           "en",
+	Charset:        "utf-8",
 	UserDirEnable:  true,
 	UserDir:        "public_spartan",
 	UserSubdomains: false,
 	CGIPaths:       []string{"cgi/"},
-	UserCGIEnable:  false, // Turned off by default because scripts are run by server user as of now
+	UserCGIEnable:  false, // Turned off by default as it needs the server to be started as root
+	CGILimits:      CGILimits{Timeout: 10},
+	DrainTimeout:   30,
+
+	RequestTimeout:   10,
+	MaxRequestLength: 4096,
+	MaxDataSize:      10485760,
+	DataTimeout:      30,
+	WriteTimeout:     30,
 }
 
 func LoadConfig(path string) (*Config, error) {
 	var err error
 	var conf Config
-	// Defaults
-	conf = *defaultConf
+	// Defaults, copied so that decoding can't change them for the next load
+	conf = *defaultConf.clone()
 
 	_, err = os.Stat(path)
 	if os.IsNotExist(err) {
 		fmt.Println(path, "does not exist, using default configuration values")
-		return &conf, nil
 	}
 	f, err := os.Open(path)
 	if err == nil {
@@ -60,15 +130,281 @@ func LoadConfig(path string) (*Config, error) {
 		if _, err = toml.Decode(string(contents), &conf); err != nil {
 			return nil, err
 		}
+		if err = loadVhosts(string(contents), &conf); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = conf.validate(); err != nil {
+		return nil, err
+	}
+	if conf.DefaultVhost != "" && conf.vhostNamed(conf.DefaultVhost) == nil {
+		return nil, fmt.Errorf("DefaultVhost %q does not match the hostname of any vhost", conf.DefaultVhost)
+	}
+
+	return &conf, nil
+}
+
+// loadVhosts decodes the [[vhost]] tables of the config file. It must be
+// called after the top level options have been decoded into conf.
+func loadVhosts(contents string, conf *Config) error {
+	var tables struct {
+		Vhost []toml.Primitive
+	}
+	md, err := toml.Decode(contents, &tables)
+	if err != nil {
+		return err
+	}
+	for _, table := range tables.Vhost {
+		vhost := conf.clone()
+		// The decoder fills arrays of tables into the elements already
+		// there, which would merge the rules of the vhost with those at the
+		// same index at the top level
+		vhost.CGI = nil
+		vhost.Access = nil
+		if err := md.PrimitiveDecode(table, vhost); err != nil {
+			return err
+		}
+		if len(vhost.CGI) == 0 {
+			vhost.CGI = append([]CGIRule(nil), conf.CGI...)
+		}
+		// Access rules at the top level apply to every vhost
+		vhost.Access = append(append([]AccessRule(nil), conf.Access...), vhost.Access...)
+		if vhost.Hostname == "" {
+			return errors.New("every [[vhost]] must set a hostname")
+		}
+		if conf.vhostNamed(vhost.Hostname) != nil {
+			return fmt.Errorf("vhost %q is defined more than once", vhost.Hostname)
+		}
+		if err := vhost.validate(); err != nil {
+			return fmt.Errorf("vhost %q: %w", vhost.Hostname, err)
+		}
+		conf.Vhosts = append(conf.Vhosts, vhost)
+	}
+	return nil
+}
+
+// clone returns a copy of conf that does not share any slices or maps with
+// it, so that decoding on top of it leaves conf untouched. Vhosts, the SCGI,
+// FastCGI and proxy routes and the redirects are not copied.
+func (conf *Config) clone() *Config {
+	c := *conf
+	c.Listen = append([]string(nil), conf.Listen...)
+	c.ProxyProtocolTrusted = append([]string(nil), conf.ProxyProtocolTrusted...)
+	c.CGIPaths = append([]string(nil), conf.CGIPaths...)
+	c.CGIPathLimits = make(map[string]CGILimits)
+	for path, limits := range conf.CGIPathLimits {
+		c.CGIPathLimits[path] = limits
+	}
+	c.CGI = append([]CGIRule(nil), conf.CGI...)
+	c.Interpreters = make(map[string]string)
+	for ext, interpreter := range conf.Interpreters {
+		c.Interpreters[ext] = interpreter
+	}
+	c.Directories = make(map[string]DirConfig)
+	for dir, options := range conf.Directories {
+		c.Directories[dir] = options
 	}
+	c.MIMETypes = make(map[string]string)
+	for ext, mimeType := range conf.MIMETypes {
+		c.MIMETypes[ext] = mimeType
+	}
+	// Routes and redirects belong to the host they are defined for
+	c.SCGI = nil
+	c.FastCGI = nil
+	c.Proxy = nil
+	c.Redirect = nil
+	c.Access = append([]AccessRule(nil), conf.Access...)
+	c.Vhosts = nil
+	c.DefaultVhost = ""
+	return &c
+}
 
-	// Config validation
+// validate fixes up invalid or inconsistent values, and returns an error for
+// those that can't be fixed up.
+func (conf *Config) validate() error {
 	if conf.DirlistSort != "name" && conf.DirlistSort != "time" && conf.DirlistSort != "size" {
 		fmt.Println("Warning: DirlistSort config option is not one of name/time/size, defaulting to name.")
 		conf.DirlistSort = "name"
 	}
+	if conf.IndexFile == "" || strings.Contains(conf.IndexFile, "/") {
+		fmt.Println("Warning: IndexFile config option is not a file name, defaulting to index.gmi.")
+		conf.IndexFile = "index.gmi"
+	}
+	if conf.DrainTimeout < 0 {
+		fmt.Println("Warning: DrainTimeout config option is negative, defaulting to 30.")
+		conf.DrainTimeout = 30
+	}
+	if conf.MaxDataSize < 0 {
+		fmt.Println("Warning: MaxDataSize config option is negative, defaulting to 10485760.")
+		conf.MaxDataSize = 10485760
+	}
+	if conf.DataTimeout <= 0 {
+		fmt.Println("Warning: DataTimeout config option is not positive, defaulting to 30.")
+		conf.DataTimeout = 30
+	}
+	if conf.RequestTimeout <= 0 {
+		fmt.Println("Warning: RequestTimeout config option is not positive, defaulting to 10.")
+		conf.RequestTimeout = 10
+	}
+	if conf.WriteTimeout <= 0 {
+		fmt.Println("Warning: WriteTimeout config option is not positive, defaulting to 30.")
+		conf.WriteTimeout = 30
+	}
+	if conf.MaxRequestLength <= 0 {
+		fmt.Println("Warning: MaxRequestLength config option is not positive, defaulting to 4096.")
+		conf.MaxRequestLength = 4096
+	}
 	// Strip trailing '/' so /~user to /~user/ redirects can work
 	conf.UserDir = strings.TrimRight(conf.UserDir, "/")
 
-	return &conf, nil
+	for _, addr := range conf.Listen {
+		if _, _, err := parseListenAddr(addr); err != nil {
+			return err
+		}
+	}
+	if conf.CGILimits.Timeout == 0 {
+		fmt.Println("Warning: CGILimits.Timeout config option is not set, defaulting to 10.")
+		conf.CGILimits.Timeout = 10
+	}
+	if err := conf.CGILimits.validate("CGILimits"); err != nil {
+		return err
+	}
+	for path, limits := range conf.CGIPathLimits {
+		if err := limits.validate(fmt.Sprintf("CGIPathLimits %q", path)); err != nil {
+			return err
+		}
+	}
+	if conf.UserCGIEnable && conf.User != "" && !canLaunchAsUsers {
+		return errors.New("usercgiEnable can't be used together with user on this system, spsrv has to keep running as root to run user scripts")
+	}
+	if conf.ProxyProtocol && len(conf.ProxyProtocolTrusted) == 0 {
+		return errors.New("ProxyProtocolTrusted must list the relays to accept PROXY protocol headers from")
+	}
+	var err error
+	if conf.proxyTrusted, err = parseCIDRs(conf.ProxyProtocolTrusted); err != nil {
+		return fmt.Errorf("ProxyProtocolTrusted: %w", err)
+	}
+	if err := conf.validateRateLimits(); err != nil {
+		return err
+	}
+	if err := conf.compileCGIRules(); err != nil {
+		return err
+	}
+	if err := conf.compileInterpreters(); err != nil {
+		return err
+	}
+	conf.compileMIMETypes()
+	if err := conf.validateDirectories(); err != nil {
+		return err
+	}
+	for i := range conf.SCGI {
+		if err := conf.SCGI[i].validate(); err != nil {
+			return err
+		}
+	}
+	for i := range conf.FastCGI {
+		if err := conf.FastCGI[i].validate(); err != nil {
+			return err
+		}
+	}
+	for i := range conf.Proxy {
+		if err := conf.Proxy[i].validate(); err != nil {
+			return err
+		}
+	}
+	for i := range conf.Access {
+		if err := conf.Access[i].validate(); err != nil {
+			return err
+		}
+	}
+	for i := range conf.Redirect {
+		if err := conf.Redirect[i].validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listenAddrs returns the addresses to listen on. Port is used when Listen
+// is empty.
+func (conf *Config) listenAddrs() []string {
+	if len(conf.Listen) != 0 {
+		return conf.Listen
+	}
+	return []string{fmt.Sprintf(":%d", conf.Port)}
+}
+
+// parseListenAddr splits a Listen entry into the network and address to pass
+// to net.Listen. Entries are host:port pairs, optionally prefixed with
+// tcp4:// or tcp6:// to only accept IPv4 or IPv6 connections.
+func parseListenAddr(addr string) (network, address string, err error) {
+	network, address = "tcp", addr
+	for _, n := range []string{"tcp4", "tcp6"} {
+		if strings.HasPrefix(addr, n+"://") {
+			network, address = n, strings.TrimPrefix(addr, n+"://")
+		}
+	}
+	if _, _, err = net.SplitHostPort(address); err != nil {
+		err = fmt.Errorf("invalid listen address %q: %w", addr, err)
+	}
+	return
+}
+
+// userCGIEnabled reports whether conf or any of its vhosts runs user CGI
+// scripts
+func (conf *Config) userCGIEnabled() bool {
+	if conf.UserCGIEnable && conf.UserDirEnable {
+		return true
+	}
+	for _, vhost := range conf.Vhosts {
+		if vhost.UserCGIEnable && vhost.UserDirEnable {
+			return true
+		}
+	}
+	return false
+}
+
+func (conf *Config) vhostNamed(name string) *Config {
+	for _, vhost := range conf.Vhosts {
+		if vhost.Hostname == name {
+			return vhost
+		}
+	}
+	return nil
+}
+
+// userSubdomainOf reports whether host is a user subdomain like user.host.name
+// that should be served by conf.
+func (conf *Config) userSubdomainOf(host string) bool {
+	return conf.Hostname != "" && conf.UserDirEnable && conf.UserSubdomains &&
+		strings.HasSuffix(host, "."+conf.Hostname)
+}
+
+// vhostFor returns the config to serve requests for host with: either conf
+// itself or one of its vhosts. Exact hostnames take precedence over user
+// subdomains, then an empty top level hostname accepts anything, and finally
+// DefaultVhost is used if set. It returns nil if no config accepts host.
+func (conf *Config) vhostFor(host string) *Config {
+	if conf.Hostname == host {
+		return conf
+	}
+	if vhost := conf.vhostNamed(host); vhost != nil {
+		return vhost
+	}
+	if conf.userSubdomainOf(host) {
+		return conf
+	}
+	for _, vhost := range conf.Vhosts {
+		if vhost.userSubdomainOf(host) {
+			return vhost
+		}
+	}
+	if conf.Hostname == "" {
+		return conf
+	}
+	if conf.DefaultVhost != "" {
+		return conf.vhostNamed(conf.DefaultVhost)
+	}
+	return nil
 }
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// loadTestConfig loads a config file with the given contents
+func loadTestConfig(t *testing.T, contents string) *Config {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "spsrv.conf")
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	conf, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conf
+}
+
+func TestVhostRoutes(t *testing.T) {
+	conf := loadTestConfig(t, `
+hostname="example.org"
+
+[[scgi]]
+path="/app/"
+address="127.0.0.1:4000"
+readTimeout=7
+
+[[fastcgi]]
+path="/php/"
+address="127.0.0.1:9000"
+
+[[proxy]]
+path="/wiki/"
+upstream="spartan://wiki.example.org/"
+
+[[vhost]]
+hostname="other.example.org"
+
+[[vhost.scgi]]
+path="/other/"
+address="127.0.0.1:4001"
+
+[[vhost]]
+hostname="third.example.org"
+`)
+	if len(conf.SCGI) != 1 || len(conf.FastCGI) != 1 || len(conf.Proxy) != 1 {
+		t.Fatalf("top level routes were not loaded: %+v %+v %+v", conf.SCGI, conf.FastCGI, conf.Proxy)
+	}
+	if conf.SCGI[0].ReadTimeout != 7 || conf.SCGI[0].ConnectTimeout != 5 {
+		t.Errorf("got timeouts %+v, want 5s to connect and 7s to read", conf.SCGI[0].BackendTimeouts)
+	}
+	other := conf.vhostNamed("other.example.org")
+	if len(other.SCGI) != 1 || other.SCGI[0].Path != "/other/" {
+		t.Errorf("got SCGI routes %+v for other.example.org, want only its own", other.SCGI)
+	}
+	third := conf.vhostNamed("third.example.org")
+	for _, vhost := range []*Config{other, third} {
+		if len(vhost.FastCGI) != 0 || len(vhost.Proxy) != 0 {
+			t.Errorf("%s took routes from the top level: %+v %+v", vhost.Hostname, vhost.FastCGI, vhost.Proxy)
+		}
+		if route := vhost.proxyRouteFor("/wiki/p.gmi"); route != nil {
+			t.Errorf("%s proxies /wiki/p.gmi to %s", vhost.Hostname, route.Upstream)
+		}
+	}
+	if len(third.SCGI) != 0 {
+		t.Errorf("third.example.org took SCGI routes from the top level: %+v", third.SCGI)
+	}
+}
+
+func TestVhostRedirects(t *testing.T) {
+	conf := loadTestConfig(t, `
+hostname="localhost"
+rootdir="`+t.TempDir()+`"
+
+[[redirect]]
+path="/old.gmi"
+to="/new.gmi"
+
+[[vhost]]
+hostname="other.localhost"
+
+[[vhost.redirect]]
+path="/other.gmi"
+to="/new.gmi"
+`)
+	for _, test := range []struct {
+		request, response string
+	}{
+		{"localhost /old.gmi 0", "3 /new.gmi\r\n"},
+		{"localhost /other.gmi 0", "4 Not found\r\n"},
+		{"other.localhost /other.gmi 0", "3 /new.gmi\r\n"},
+		{"other.localhost /old.gmi 0", "4 Not found\r\n"},
+	} {
+		if response := doRequest(t, conf, test.request, ""); response != test.response {
+			t.Errorf("%q: got response %q, want %q", test.request, response, test.response)
+		}
+	}
+}
+
+func TestVhostCGIRules(t *testing.T) {
+	conf := loadTestConfig(t, `
+hostname="example.org"
+
+[[cgi]]
+glob="*.cgi"
+interpreter="sh"
+userAllowed=true
+timeout=9
+
+[[vhost]]
+hostname="regex.example.org"
+
+[[vhost.cgi]]
+regex='\.py$'
+
+[[vhost]]
+hostname="glob.example.org"
+
+[[vhost.cgi]]
+glob="*.pl"
+
+[[vhost]]
+hostname="inherit.example.org"
+`)
+	if len(conf.CGI) != 1 || conf.CGI[0].Glob != "*.cgi" || !conf.CGI[0].UserAllowed || conf.CGI[0].Interpreter != "sh" {
+		t.Errorf("top level rules changed: %+v", conf.CGI)
+	}
+	for _, hostname := range []string{"regex.example.org", "glob.example.org"} {
+		vhost := conf.vhostNamed(hostname)
+		if len(vhost.CGI) != 1 {
+			t.Errorf("got %d CGI rules for %s, want only its own", len(vhost.CGI), hostname)
+			continue
+		}
+		rule := vhost.CGI[0]
+		if rule.Glob == "*.cgi" || rule.UserAllowed || rule.Interpreter != "" || rule.Timeout != 0 {
+			t.Errorf("%s took options from the top level rule: %+v", hostname, rule)
+		}
+	}
+	inherit := conf.vhostNamed("inherit.example.org")
+	if len(inherit.CGI) != 1 || inherit.cgiRuleFor("app.cgi") == nil {
+		t.Errorf("got CGI rules %+v for inherit.example.org, want those of the top level", inherit.CGI)
+	}
+}
+
+func TestVhostAccessRules(t *testing.T) {
+	conf := loadTestConfig(t, `
+hostname="example.org"
+
+[[access]]
+deny=["192.0.2.0/24"]
+
+[[vhost]]
+hostname="other.example.org"
+
+[[vhost.access]]
+path="/private/"
+allow=["10.0.0.0/8"]
+
+[[vhost]]
+hostname="third.example.org"
+`)
+	if len(conf.Access) != 1 || conf.Access[0].Path != "" || len(conf.Access[0].Allow) != 0 {
+		t.Errorf("top level rules changed: %+v", conf.Access)
+	}
+	other := conf.vhostNamed("other.example.org")
+	if len(other.Access) != 2 {
+		t.Fatalf("got access rules %+v for other.example.org, want the top level one and its own", other.Access)
+	}
+	if rule := other.Access[0]; rule.Path != "" || len(rule.Allow) != 0 || len(rule.Deny) != 1 {
+		t.Errorf("got %+v as the top level rule of other.example.org", rule)
+	}
+	if rule := other.Access[1]; rule.Path != "/private/" || len(rule.Allow) != 1 || len(rule.Deny) != 0 {
+		t.Errorf("got %+v as the own rule of other.example.org", rule)
+	}
+	if third := conf.vhostNamed("third.example.org"); len(third.Access) != 1 {
+		t.Errorf("got access rules %+v for third.example.org, want the top level one", third.Access)
+	}
+
+	// Requests from 192.0.2.1 are denied on every path of every host, and
+	// only those from 10.0.0.0/8 get to /private/ on other.example.org
+	for _, test := range []struct {
+		host, path, ip string
+		denied         bool
+	}{
+		{"example.org", "/", "192.0.2.1", true},
+		{"other.example.org", "/", "192.0.2.1", true},
+		{"other.example.org", "/", "198.51.100.1", false},
+		{"other.example.org", "/private/", "198.51.100.1", true},
+		{"other.example.org", "/private/", "10.1.2.3", false},
+		{"third.example.org", "/private/", "192.0.2.1", true},
+	} {
+		vhost := conf.vhostFor(test.host)
+		netConn, _ := pipeFrom(t, test.ip)
+		req := &Request{host: test.host, path: test.path, netConn: &netConn}
+		if denied := accessDenied(vhost, req, false) != ""; denied != test.denied {
+			t.Errorf("%s%s from %s: got denied=%v, want %v", test.host, test.path, test.ip, denied, test.denied)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+var errRequestTooLong = errors.New("request line too long")
+
+// readRequestLine reads the request line from r, without the trailing CRLF.
+// Lines longer than the buffer of r are rejected.
+func readRequestLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", errRequestTooLong
+	}
+	// Be lenient with clients that close their end without a line break
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return "", err
+	}
+	return string(bytes.TrimRight(line, "\r\n")), nil
+}
+
+// isTimeout reports whether err is from a deadline being reached
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// timeoutConn extends the write deadline of a connection before every write,
+// so that writes only time out if the client stops reading.
+type timeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	n, err := c.Conn.Write(b)
+	if isTimeout(err) {
+		log.Println("Timed out writing to client")
+	}
+	return n, err
+}
+
+// sendfileChunk is the most written by one call to sendfile, after which the
+// write deadline is extended.
+const sendfileChunk = 1 << 20
+
+// ReadFrom lets io.Copy send files with sendfile where the kernel supports it,
+// which it would not do through the wrapper otherwise.
+func (c *timeoutConn) ReadFrom(r io.Reader) (n int64, err error) {
+	for {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+		var written int64
+		written, err = io.CopyN(c.Conn, r, sendfileChunk)
+		n += written
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			if isTimeout(err) {
+				log.Println("Timed out writing to client")
+			}
+			return n, err
+		}
+	}
+}
+
+// dataBlock reads the data block of a request from the connection, and
+// remembers whether the client took too long to send it.
+type dataBlock struct {
+	r         io.Reader
+	timedOut  int32
+	onTimeout func() // Called before the error is returned, if set
+}
+
+func (d *dataBlock) Read(b []byte) (int, error) {
+	n, err := d.r.Read(b)
+	if isTimeout(err) && atomic.CompareAndSwapInt32(&d.timedOut, 0, 1) {
+		log.Println("Timed out reading data block")
+		if d.onTimeout != nil {
+			d.onTimeout()
+		}
+	}
+	return n, err
+}
+
+// timedOutReading reports whether reading the data block hit the read
+// deadline, in which case the client is sent a 4 response if nothing was sent
+// yet.
+func (d *dataBlock) timedOutReading() bool {
+	return atomic.LoadInt32(&d.timedOut) == 1
+}
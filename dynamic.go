@@ -3,128 +3,377 @@ package main
 import (
 	"bufio"
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/user"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
-func handleCGI(conf *Config, req *Request, cgiPath string) (ok bool) {
+// cgiRunning is the number of CGI processes currently running
+var cgiRunning int64
+
+// handleCGI runs the script the request is for if it matches one of the CGI
+// rules. ok is false if the request should be served as a static file instead.
+func handleCGI(conf *Config, req *Request) (ok bool) {
 	ok = true
-	path := req.filePath
 	conn := req.conn
-	scriptPath := filepath.Join(conf.RootDir, req.filePath)
-
+	root := conf.RootDir
 	if req.user != "" {
-		scriptPath = filepath.Join("/home", req.user, conf.UserDir, req.filePath)
+		root = filepath.Join("/home", req.user, conf.UserDir)
 	}
 
-	info, err := os.Stat(scriptPath)
+	path, pathInfo, info, err := findScript(root, req.filePath)
 	if err != nil {
-		log.Println(err.Error())
 		ok = false
 		return
 	}
-	if !(info.Mode().Perm()&0555 == 0555) {
+	rule := conf.cgiRuleFor(path)
+	if rule == nil {
+		ok = false
+		return
+	}
+	if req.user != "" && !rule.UserAllowed {
+		log.Println("CGI rule for", rule, "does not allow user scripts")
+		ok = false
+		return
+	}
+	log.Println("Attempting CGI:", path)
+	scriptPath := filepath.Join(root, path)
+	// Scripts run through an interpreter only need to be readable by it
+	command := conf.cgiCommandFor(rule, path)
+	if command == nil && !(info.Mode().Perm()&0555 == 0555) {
 		log.Println("File not executable")
 		ok = false
 		return
 	}
 
+	if reason := accessDenied(conf, req, true); reason != "" {
+		denyAccess(req, reason)
+		return
+	}
+	if ip := remoteIP(*req.netConn); !cgiLimiter.allow(ip, conf.CGIRateLimit, conf.CGIRateBurst) {
+		logThrottle(ip, fmt.Sprintf("more than %g CGI requests per second", conf.CGIRateLimit))
+		sendResponseHeader(conn, statusServerError, slowDown)
+		return
+	}
+
 	// Prepare environment variables
-	vars := prepareCGIVariables(conf, req, scriptPath)
+	vars := prepareCGIVariables(conf, req, scriptPath, scriptName(req, path), pathInfo)
+	if pathInfo != "" {
+		vars["PATH_TRANSLATED"] = filepath.Join(root, pathInfo)
+	}
+
+	// User scripts are run as the user owning them
+	var cred *syscall.Credential
+	if req.user != "" {
+		var home string
+		cred, home, err = userCredential(req.user, info)
+		if err != nil {
+			log.Println("Refusing to run CGI script "+scriptPath+":", err.Error())
+			conn.Write([]byte("5 CGI error\r\n"))
+			return
+		}
+		vars["HOME"] = home
+	}
 
 	log.Println("Running script:", scriptPath)
 
 	// Spawn process
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	limits := rule.limits
+	ctx, cancel := context.WithTimeout(req.ctx, time.Duration(limits.Timeout)*time.Second)
 	defer cancel()
-	cmd := exec.CommandContext(ctx, scriptPath)
-
-	// Put input data into stdin pipe
-	stdin, err := cmd.StdinPipe()
-	if err != nil {
-		log.Println("Error creating a stdin pipe:", err.Error())
-		ok = false
-		return
+	var cmd *exec.Cmd
+	if command != nil {
+		cmd = cgiCommand(limits, command[0], append(command[1:len(command):len(command)], scriptPath)...)
+	} else {
+		cmd = cgiCommand(limits, scriptPath)
 	}
-	io.WriteString(stdin, req.data)
-	stdin.Close()
+	proc := &cgiProcess{cmd: cmd}
+
+	// Put input data into stdin
+	cmd.Stdin = req.data
+	// Scripts should not act on a data block that was cut short, so they are
+	// killed before they see the end of their input
+	req.data.onTimeout = func() { proc.kill("") }
 
 	// Set environment variables
 	cmd.Env = []string{}
 	for key, value := range vars {
 		cmd.Env = append(cmd.Env, key+"="+value)
 	}
-	// Manually change the uid/gid for the command
-	// Fetch user info
-	// user, err := user.Lookup(req.user)
-	// if err == nil {
-	// 	tmp, _ := strconv.ParseUint(user.Uid, 10, 32)
-	// 	uid := uint32(tmp)
-	// 	tmp, _ = strconv.ParseUint(user.Gid, 10, 32)
-	// 	gid := uint32(tmp)
-	// 	cmd.SysProcAttr = &syscall.SysProcAttr{}
-	// 	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uid, Gid: gid}
-	// }
-
-	// Fetch and check output
-	response, err := cmd.Output()
-
-	if ctx.Err() == context.DeadlineExceeded {
-		log.Println("Terminating CGI process " + path + " due to exceeding 10 second runtime limit.")
-		conn.Write([]byte("5 CGI process timed out!\r\n"))
+	cmd.SysProcAttr.Credential = cred
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		log.Println("Error creating a stdout pipe:", err.Error())
+		ok = false
 		return
 	}
+	stderr, err := cmd.StderrPipe()
 	if err != nil {
+		log.Println("Error creating a stderr pipe:", err.Error())
+		ok = false
+		return
+	}
+
+	if err = startCGI(cmd); err != nil {
 		log.Println("Error running CGI program " + path + ": " + err.Error())
 		if strings.Contains(err.Error(), "permission denied") {
 			ok = false
 			return
 		}
-		if err, ok := err.(*exec.ExitError); ok {
-			log.Println("↳ stderr output: " + string(err.Stderr))
-		}
 		conn.Write([]byte("5 CGI error\r\n"))
 		return
 	}
-	// Extract response header
-	header, _, err := bufio.NewReader(strings.NewReader(string(response))).ReadLine()
-	_, err2 := strconv.Atoi(strings.Fields(string(header))[0])
-	if err != nil || err2 != nil {
-		log.Println("Unable to parse first line of output from CGI process " + path + " as valid Gemini response header.  Line was: " + string(header))
+	atomic.AddInt64(&cgiRunning, 1)
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			if ctx.Err() == context.DeadlineExceeded {
+				proc.kill(fmt.Sprintf("exceeding %d second runtime limit", limits.Timeout))
+			} else {
+				proc.kill("server shutdown")
+			}
+		case <-exited:
+		}
+	}()
+	stderrDone := make(chan struct{})
+	go func() {
+		logStderr(path, stderr)
+		close(stderrDone)
+	}()
+
+	// Check the response header as soon as it is there, then pass on the
+	// rest of the output as it is written
+	out := &limitWriter{w: conn, limit: limits.OutputSize, exceeded: func() {
+		proc.kill(fmt.Sprintf("exceeding %d byte output size limit", limits.OutputSize))
+	}}
+	output := bufio.NewReaderSize(stdout, maxHeaderLength)
+	header, headerErr := readResponseHeader(output)
+	headerSent := false
+	if headerErr != nil {
+		proc.kill("")
+	} else if _, err = out.Write(header); err == nil {
+		headerSent = true
+		log.Println("Returning CGI output")
+		_, err = io.Copy(out, output)
+	}
+	if err != nil {
+		// Either the client went away or the output limit was reached, in
+		// both cases there is no point in letting the script carry on.
+		proc.kill("")
+	}
+	// Make sure nothing is left in the pipes, so that Wait does not block
+	io.Copy(ioutil.Discard, stdout)
+	<-stderrDone
+	err = cmd.Wait()
+	close(exited)
+	atomic.AddInt64(&cgiRunning, -1)
+
+	if limits.CPUTime > 0 && !proc.wasKilled() {
+		if status, isWait := cmd.ProcessState.Sys().(syscall.WaitStatus); isWait && status.Signaled() &&
+			(status.Signal() == syscall.SIGXCPU || status.Signal() == syscall.SIGKILL) {
+			proc.kill(fmt.Sprintf("exceeding %d second CPU time limit", limits.CPUTime))
+		}
+	}
+	if reason := proc.killedFor(); reason != "" {
+		log.Println("Terminating CGI process group of " + path + " due to " + reason + ".")
+		if headerSent {
+			return
+		}
+		if strings.Contains(reason, "runtime") {
+			conn.Write([]byte("5 CGI process timed out!\r\n"))
+		} else {
+			conn.Write([]byte("5 CGI process exceeded its resource limits\r\n"))
+		}
+		return
+	}
+	if req.data.timedOutReading() && !headerSent {
+		conn.Write([]byte("4 Timed out reading data block\r\n"))
+		return
+	}
+	if headerErr != nil {
+		log.Println("Unable to parse first line of output from CGI process " + path + " as valid Spartan response header: " + headerErr.Error() + ". Line was: " + strings.TrimRight(string(header), "\r\n"))
 		conn.Write([]byte("5 CGI error\r\n"))
 		return
 	}
-	log.Println("Returning CGI output")
-	// Write response
-	conn.Write(response)
+	if err != nil {
+		log.Println("Error running CGI program " + path + ": " + err.Error())
+		if !headerSent {
+			conn.Write([]byte("5 CGI error\r\n"))
+		}
+	}
 	return
 }
 
-func prepareCGIVariables(conf *Config, req *Request, script_path string) map[string]string {
-	vars := prepareGatewayVariables(conf, req)
+// Response headers are made up of a status, a space, up to 1024 bytes of meta
+// and CRLF
+const maxHeaderLength = 1 + 1 + 1024 + 2
+
+// readResponseHeader reads the first line of a response from r and checks that
+// it is a valid spartan response header. The line read so far is returned
+// along with any error.
+func readResponseHeader(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	line = append([]byte(nil), line...)
+	if err == bufio.ErrBufferFull {
+		return line, errors.New("header is too long")
+	}
+	if err != nil {
+		return line, err
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) == 0 {
+		return line, errors.New("header is empty")
+	}
+	if status, err := strconv.Atoi(fields[0]); err != nil || status < statusSuccess || status > statusServerError {
+		return line, fmt.Errorf("invalid status %q", fields[0])
+	}
+	return line, nil
+}
+
+// logStderr logs each line of stderr output from a gateway process
+func logStderr(path string, stderr io.Reader) {
+	s := bufio.NewScanner(stderr)
+	for s.Scan() {
+		log.Println("↳ stderr output from " + path + ": " + s.Text())
+	}
+	// Very long lines stop the scanner, skip whatever is left
+	io.Copy(ioutil.Discard, stderr)
+}
+
+// userCredential returns the credential to run a CGI script of username with,
+// and their home directory. The script must be owned by username. The
+// credential is nil if the server is already running as that user.
+func userCredential(username string, script os.FileInfo) (*syscall.Credential, string, error) {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, "", err
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid uid %q for user %s", u.Uid, username)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid gid %q for user %s", u.Gid, username)
+	}
+	stat, ok := script.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil, "", errors.New("unable to find the owner of the script")
+	}
+	if uint64(stat.Uid) != uid {
+		return nil, "", fmt.Errorf("script is owned by uid %d, not by %s", stat.Uid, username)
+	}
+	if uint64(os.Getuid()) == uid {
+		return nil, u.HomeDir, nil
+	}
+
+	groupIds, err := u.GroupIds()
+	if err != nil {
+		return nil, "", err
+	}
+	var groups []uint32
+	for _, id := range groupIds {
+		g, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid group id %q for user %s", id, username)
+		}
+		groups = append(groups, uint32(g))
+	}
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: groups}, u.HomeDir, nil
+}
+
+// findScript finds the file to run for filePath, which is relative to root.
+// Path segments after the file are returned as pathInfo, so that
+// cgi/app.sh/foo/bar runs cgi/app.sh with a pathInfo of /foo/bar.
+func findScript(root, filePath string) (script, pathInfo string, info os.FileInfo, err error) {
+	parts := strings.Split(strings.Trim(filePath, "/"), "/")
+	for i := 1; i <= len(parts); i++ {
+		script = strings.Join(parts[:i], "/")
+		info, err = os.Stat(filepath.Join(root, script))
+		if err != nil {
+			return
+		}
+		if !info.IsDir() {
+			if i < len(parts) {
+				pathInfo = "/" + strings.Join(parts[i:], "/")
+			}
+			return
+		}
+	}
+	err = fmt.Errorf("%s is a directory", filepath.Join(root, script))
+	return
+}
+
+// scriptName returns the URL path of a script, given its path relative to
+// the root or user directory.
+func scriptName(req *Request, script string) string {
+	if req.user != "" && req.vhost == "" {
+		return "/~" + req.user + "/" + script
+	}
+	return "/" + script
+}
+
+func prepareCGIVariables(conf *Config, req *Request, script_path, scriptName, pathInfo string) map[string]string {
+	vars := prepareGatewayVariables(conf, req, scriptName, pathInfo)
 	vars["GATEWAY_INTERFACE"] = "CGI/1.1"
 	vars["SCRIPT_PATH"] = script_path
+	vars["SCRIPT_FILENAME"] = script_path
 	return vars
 }
 
-func prepareGatewayVariables(conf *Config, req *Request) map[string]string {
+func prepareGatewayVariables(conf *Config, req *Request, scriptName, pathInfo string) map[string]string {
 	vars := make(map[string]string)
-	vars["REQUEST_METHOD"] = ""
+	// Spartan has no methods, but CGI programs written for HTTP tend to
+	// expect one. A data block is the closest thing to a POST body.
+	vars["REQUEST_METHOD"] = "GET"
+	if req.dataLen != 0 {
+		vars["REQUEST_METHOD"] = "POST"
+	}
 	vars["SERVER_NAME"] = conf.Hostname
-	vars["SERVER_PORT"] = strconv.Itoa(conf.Port)
+	if conf.Hostname == "" {
+		vars["SERVER_NAME"] = req.host
+	}
+	// The address of the listener that accepted the connection, as there can
+	// be more than one
+	addr, port, _ := net.SplitHostPort((*req.netConn).LocalAddr().String())
+	vars["SERVER_ADDR"] = addr
+	vars["SERVER_PORT"] = port
 	vars["SERVER_PROTOCOL"] = "SPARTAN"
 	vars["SERVER_SOFTWARE"] = "SPSRV"
 
+	vars["SCRIPT_NAME"] = scriptName
+	vars["PATH_INFO"] = pathInfo
+	vars["QUERY_STRING"] = req.query
+	spartanURL := url.URL{Scheme: "spartan", Host: req.host, Path: req.path, RawQuery: req.query}
+	if port != "300" {
+		spartanURL.Host = net.JoinHostPort(req.host, port)
+	}
+	vars["SPARTAN_URL"] = spartanURL.String()
+	if req.user != "" {
+		vars["USER_DIR_OWNER"] = req.user
+	}
+
 	vars["DATA_LENGTH"] = strconv.Itoa(req.dataLen)
+	vars["CONTENT_LENGTH"] = strconv.Itoa(req.dataLen)
 
-	host, _, _ := net.SplitHostPort((*req.netConn).RemoteAddr().String())
+	// REMOTE_USER and AUTH_TYPE are left out, as clients never authenticate
+	host, remotePort, _ := net.SplitHostPort((*req.netConn).RemoteAddr().String())
 	vars["REMOTE_ADDR"] = host
+	vars["REMOTE_PORT"] = remotePort
 	return vars
 }
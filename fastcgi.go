@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FastCGIRoute passes requests under Path on to the FastCGI responder at
+// Address, reusing connections between requests.
+type FastCGIRoute struct {
+	Path           string
+	Address        string // host:port, or unix:/path/to/socket
+	ScriptFilename string // Passed as SCRIPT_FILENAME, which PHP-FPM needs
+	MaxIdle        int    // Idle connections kept open to the backend
+	BackendTimeouts
+}
+
+func (route *FastCGIRoute) validate() error {
+	if !strings.HasPrefix(route.Path, "/") {
+		return fmt.Errorf("FastCGI path %q must start with /", route.Path)
+	}
+	if route.Address == "" {
+		return fmt.Errorf("FastCGI route for %s must have an address", route.Path)
+	}
+	if route.MaxIdle < 0 {
+		return fmt.Errorf("FastCGI route for %s must not have a negative MaxIdle", route.Path)
+	}
+	if route.MaxIdle == 0 {
+		route.MaxIdle = 4
+	}
+	route.BackendTimeouts.setDefaults()
+	return nil
+}
+
+// fastCGIRouteFor returns the first FastCGI route reqPath is under, if any
+func (conf *Config) fastCGIRouteFor(reqPath string) *FastCGIRoute {
+	for i := range conf.FastCGI {
+		if _, ok := matchMount(conf.FastCGI[i].Path, reqPath); ok {
+			return &conf.FastCGI[i]
+		}
+	}
+	return nil
+}
+
+// Record types and other values from the FastCGI specification
+const (
+	fcgiVersion      = 1
+	fcgiBeginRequest = 1
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+
+	fcgiResponder       = 1
+	fcgiKeepConn        = 1
+	fcgiRequestComplete = 0
+
+	fcgiHeaderLength = 8
+	fcgiMaxContent   = 65535
+	// Connections only ever carry one request at a time
+	fcgiRequestID = 1
+)
+
+// fcgiPool keeps idle connections to a FastCGI backend. Pools are shared by
+// every route with the same address and outlive config reloads.
+type fcgiPool struct {
+	idle chan net.Conn
+}
+
+var fcgiPools = struct {
+	sync.Mutex
+	m map[string]*fcgiPool
+}{m: make(map[string]*fcgiPool)}
+
+func fcgiPoolFor(route *FastCGIRoute) *fcgiPool {
+	key := fmt.Sprintf("%s/%d", route.Address, route.MaxIdle)
+	fcgiPools.Lock()
+	defer fcgiPools.Unlock()
+	pool, ok := fcgiPools.m[key]
+	if !ok {
+		pool = &fcgiPool{idle: make(chan net.Conn, route.MaxIdle)}
+		fcgiPools.m[key] = pool
+	}
+	return pool
+}
+
+// get returns an idle connection, or a new one if there is none. reused is
+// true for idle connections, which the backend may have closed since.
+func (pool *fcgiPool) get(route *FastCGIRoute) (conn net.Conn, reused bool, err error) {
+	select {
+	case conn = <-pool.idle:
+		return conn, true, nil
+	default:
+		conn, err = dialBackend(route.Address, route.connectTimeout())
+		return conn, false, err
+	}
+}
+
+// put keeps conn for another request, or closes it if the pool is full
+func (pool *fcgiPool) put(conn net.Conn) {
+	conn.SetDeadline(time.Time{})
+	select {
+	case pool.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func handleFastCGI(conf *Config, req *Request, route *FastCGIRoute) {
+	conn := req.conn
+	pathInfo, _ := matchMount(route.Path, req.path)
+	vars := prepareCGIVariables(conf, req, route.ScriptFilename, strings.TrimSuffix(route.Path, "/"), pathInfo)
+	if route.ScriptFilename == "" {
+		delete(vars, "SCRIPT_PATH")
+		delete(vars, "SCRIPT_FILENAME")
+	}
+	readTimeout := route.readTimeout()
+
+	log.Println("Passing request to FastCGI backend:", route.Address)
+	pool := fcgiPoolFor(route)
+	var backend net.Conn
+	var resp *fcgiResponse
+	var output *bufio.Reader
+	var header []byte
+	var err error
+	// A connection from the pool may have been closed by the backend in the
+	// meantime, in which case the request is tried again on a new one.
+	for retry := true; retry; {
+		var reused bool
+		resp = nil
+		if req.dataLen != 0 {
+			// The data block is streamed from the client and can't be sent
+			// again, so it goes to a new connection that can't be stale
+			backend, err = dialBackend(route.Address, route.connectTimeout())
+		} else {
+			backend, reused, err = pool.get(route)
+		}
+		if err != nil {
+			log.Println("Error connecting to FastCGI backend:", err.Error())
+			sendResponseHeader(conn, statusServerError, "FastCGI backend unavailable")
+			return
+		}
+		err = writeFastCGIRequest(&deadlineWriter{backend, readTimeout}, vars, req.data)
+		if err == nil {
+			resp = &fcgiResponse{r: bufio.NewReader(&deadlineReader{backend, readTimeout}), path: route.Path}
+			output = bufio.NewReaderSize(resp, maxHeaderLength)
+			header, err = readResponseHeader(output)
+		}
+		retry = err != nil && reused && (resp == nil || !resp.gotRecord)
+		if err != nil {
+			backend.Close()
+		}
+	}
+	if err != nil && req.data.timedOutReading() {
+		sendResponseHeader(conn, statusClientError, "Timed out reading data block")
+		return
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		log.Println("Timed out waiting for FastCGI backend", route.Address)
+		sendResponseHeader(conn, statusServerError, "FastCGI backend timed out")
+		return
+	}
+	if err != nil {
+		log.Println("Unable to parse first line of output from FastCGI backend " + route.Address + " as valid Spartan response header: " + err.Error() + ". Line was: " + strings.TrimRight(string(header), "\r\n"))
+		sendResponseHeader(conn, statusServerError, "FastCGI backend error")
+		return
+	}
+
+	log.Println("Returning FastCGI output")
+	if _, err = conn.Write(header); err == nil {
+		_, err = io.Copy(conn, output)
+	}
+	if err != nil {
+		log.Println("Error relaying FastCGI response:", err.Error())
+		backend.Close()
+		return
+	}
+	if !resp.ended {
+		log.Println("FastCGI response was cut short, the backend did not end the request")
+		backend.Close()
+		return
+	}
+	if resp.protocolStatus != fcgiRequestComplete {
+		log.Println("FastCGI backend did not complete the request, protocol status", resp.protocolStatus)
+		backend.Close()
+		return
+	}
+	pool.put(backend)
+}
+
+// writeFastCGIRequest sends a request with the given params and stdin
+func writeFastCGIRequest(conn io.Writer, vars map[string]string, stdin io.Reader) error {
+	w := bufio.NewWriter(conn)
+	writeRecord(w, fcgiBeginRequest, []byte{0, fcgiResponder, fcgiKeepConn, 0, 0, 0, 0, 0})
+
+	var params []byte
+	keys := make([]string, 0, len(vars))
+	for key := range vars {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		params = appendParamLength(params, len(key))
+		params = appendParamLength(params, len(vars[key]))
+		params = append(params, key...)
+		params = append(params, vars[key]...)
+	}
+	writeStream(w, fcgiParams, params)
+
+	content := make([]byte, fcgiMaxContent)
+	for {
+		n, err := stdin.Read(content)
+		if n > 0 {
+			writeRecord(w, fcgiStdin, content[:n])
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	writeRecord(w, fcgiStdin, nil)
+	return w.Flush()
+}
+
+// writeStream writes content as records of type recType, followed by an
+// empty record ending the stream.
+func writeStream(w *bufio.Writer, recType byte, content []byte) {
+	for len(content) > 0 {
+		n := len(content)
+		if n > fcgiMaxContent {
+			n = fcgiMaxContent
+		}
+		writeRecord(w, recType, content[:n])
+		content = content[n:]
+	}
+	writeRecord(w, recType, nil)
+}
+
+func writeRecord(w *bufio.Writer, recType byte, content []byte) {
+	header := [fcgiHeaderLength]byte{fcgiVersion, recType}
+	binary.BigEndian.PutUint16(header[2:], fcgiRequestID)
+	binary.BigEndian.PutUint16(header[4:], uint16(len(content)))
+	w.Write(header[:])
+	w.Write(content)
+}
+
+// appendParamLength encodes the length of a name or value, which takes one
+// byte below 128 and four bytes otherwise.
+func appendParamLength(b []byte, n int) []byte {
+	if n < 128 {
+		return append(b, byte(n))
+	}
+	return append(b, byte(n>>24)|0x80, byte(n>>16), byte(n>>8), byte(n))
+}
+
+// fcgiResponse reads the stdout stream of a FastCGI response, logging
+// anything sent on stderr, until the end of the request.
+type fcgiResponse struct {
+	r    *bufio.Reader
+	path string
+
+	gotRecord      bool
+	remaining      int // Bytes of stdout left in the current record
+	padding        int
+	ended          bool
+	protocolStatus byte
+}
+
+func (resp *fcgiResponse) Read(b []byte) (int, error) {
+	for resp.remaining == 0 {
+		if resp.padding > 0 {
+			if _, err := resp.r.Discard(resp.padding); err != nil {
+				return 0, err
+			}
+			resp.padding = 0
+		}
+		if resp.ended {
+			return 0, io.EOF
+		}
+		if err := resp.readRecordHeader(); err != nil {
+			return 0, unexpectedEOF(err)
+		}
+	}
+	if len(b) > resp.remaining {
+		b = b[:resp.remaining]
+	}
+	n, err := resp.r.Read(b)
+	resp.remaining -= n
+	return n, unexpectedEOF(err)
+}
+
+// unexpectedEOF turns io.EOF into io.ErrUnexpectedEOF, as the backend
+// closing the connection before ending the request cuts the response short
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// readRecordHeader reads records until the start of some stdout content or
+// the end of the request.
+func (resp *fcgiResponse) readRecordHeader() error {
+	var header [fcgiHeaderLength]byte
+	if _, err := io.ReadFull(resp.r, header[:]); err != nil {
+		return err
+	}
+	resp.gotRecord = true
+	if header[0] != fcgiVersion {
+		return fmt.Errorf("unsupported FastCGI version %d", header[0])
+	}
+	length := int(binary.BigEndian.Uint16(header[4:]))
+	resp.padding = int(header[6])
+
+	switch header[1] {
+	case fcgiStdout:
+		resp.remaining = length
+		return nil
+	case fcgiStderr:
+		content := make([]byte, length)
+		if _, err := io.ReadFull(resp.r, content); err != nil {
+			return err
+		}
+		for _, line := range strings.Split(strings.TrimRight(string(content), "\n"), "\n") {
+			if line != "" {
+				log.Println("↳ stderr output from " + resp.path + ": " + line)
+			}
+		}
+		return nil
+	case fcgiEndRequest:
+		content := make([]byte, length)
+		if _, err := io.ReadFull(resp.r, content); err != nil {
+			return err
+		}
+		if length < 5 {
+			return errors.New("FastCGI end request record is too short")
+		}
+		resp.protocolStatus = content[4]
+		resp.ended = true
+		return nil
+	default:
+		_, err := io.CopyN(ioutil.Discard, resp.r, int64(length))
+		return err
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startFastCGIBackend starts a stand-in FastCGI responder on a loopback
+// listener. For every request on a connection it calls respond with a writer
+// for the records of the response, and closes the connection if it returns
+// false.
+func startFastCGIBackend(t *testing.T, respond func(w *bufio.Writer) bool) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				w := bufio.NewWriter(conn)
+				for readFastCGIRequest(r) == nil {
+					keep := respond(w)
+					w.Flush()
+					if !keep {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// readFastCGIRequest reads records up to the end of the stdin stream
+func readFastCGIRequest(r *bufio.Reader) error {
+	for {
+		var header [fcgiHeaderLength]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return err
+		}
+		length := int(binary.BigEndian.Uint16(header[4:]))
+		if _, err := r.Discard(length + int(header[6])); err != nil {
+			return err
+		}
+		if header[1] == fcgiStdin && length == 0 {
+			return nil
+		}
+	}
+}
+
+func fastCGITestConfig(t *testing.T, addr string) (*Config, *fcgiPool) {
+	t.Helper()
+	conf := testConfig(t)
+	conf.FastCGI = []FastCGIRoute{{Path: "/app", Address: addr}}
+	if err := conf.validate(); err != nil {
+		t.Fatal(err)
+	}
+	return conf, fcgiPoolFor(&conf.FastCGI[0])
+}
+
+func TestFastCGI(t *testing.T) {
+	addr := startFastCGIBackend(t, func(w *bufio.Writer) bool {
+		writeStream(w, fcgiStdout, []byte("2 text/plain\r\nhello"))
+		writeRecord(w, fcgiEndRequest, []byte{0, 0, 0, 0, fcgiRequestComplete, 0, 0, 0})
+		return true
+	})
+	conf, pool := fastCGITestConfig(t, addr)
+	for i := 0; i < 2; i++ {
+		if response := doRequest(t, conf, "localhost /app 0", ""); response != "2 text/plain\r\nhello" {
+			t.Errorf("got response %q", response)
+		}
+		if len(pool.idle) != 1 {
+			t.Errorf("got %d idle connections after a complete response, want 1", len(pool.idle))
+		}
+	}
+}
+
+func TestFastCGITruncated(t *testing.T) {
+	addr := startFastCGIBackend(t, func(w *bufio.Writer) bool {
+		// Close without ending the stdout stream or the request
+		writeRecord(w, fcgiStdout, []byte("2 text/plain\r\npartial"))
+		return false
+	})
+	conf, pool := fastCGITestConfig(t, addr)
+	if response := doRequest(t, conf, "localhost /app 0", ""); response != "2 text/plain\r\npartial" {
+		t.Errorf("got response %q", response)
+	}
+	if len(pool.idle) != 0 {
+		t.Errorf("the connection of a truncated response went back to the pool")
+	}
+}
+
+func TestFastCGISlowDataBlock(t *testing.T) {
+	addr := startFastCGIBackend(t, func(w *bufio.Writer) bool {
+		writeStream(w, fcgiStdout, []byte("2 text/plain\r\nhello"))
+		writeRecord(w, fcgiEndRequest, []byte{0, 0, 0, 0, fcgiRequestComplete, 0, 0, 0})
+		return true
+	})
+	conf, _ := fastCGITestConfig(t, addr)
+	conf.FastCGI[0].ReadTimeout = 1
+	response := doSlowRequest(t, startServer(t, conf), "localhost /app 10", "helloworld", 1500*time.Millisecond)
+	if response != "2 text/plain\r\nhello" {
+		t.Errorf("got response %q", response)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// DirConfig overrides options for requests under a directory
+type DirConfig struct {
+	Lang    string
+	Charset string
+}
+
+func (conf *Config) validateDirectories() error {
+	for dir := range conf.Directories {
+		if !strings.HasPrefix(dir, "/") {
+			return fmt.Errorf("directory %q must start with /", dir)
+		}
+	}
+	return nil
+}
+
+// dirConfigFor returns the options for urlPath, from the longest directory in
+// Directories it is under, on top of the top level ones. Those of .spsrv files
+// take precedence over both.
+func (conf *Config) dirConfigFor(urlPath string) DirConfig {
+	options := DirConfig{Lang: conf.Lang, Charset: conf.Charset}
+	longest := ""
+	for dir := range conf.Directories {
+		if _, ok := matchMount(dir, urlPath); ok && len(dir) > len(longest) {
+			longest = dir
+		}
+	}
+	if dirOptions, ok := conf.Directories[longest]; ok {
+		if dirOptions.Lang != "" {
+			options.Lang = dirOptions.Lang
+		}
+		if dirOptions.Charset != "" {
+			options.Charset = dirOptions.Charset
+		}
+	}
+	if conf.local != nil {
+		if conf.local.Lang != "" {
+			options.Lang = conf.local.Lang
+		}
+		if conf.local.Charset != "" {
+			options.Charset = conf.local.Charset
+		}
+	}
+	return options
+}
+
+// langSuffix matches language tags such as de, zh-Hant or pt-BR in file
+// names like index.de.gmi: an ISO 639-1 code, optionally followed by a script
+// and a region.
+var langSuffix = regexp.MustCompile(`^([a-z]{2})(-[A-Z][a-z]{3})?(-([A-Z]{2}|[0-9]{3}))?$`)
+
+// iso639 holds the two letter ISO 639-1 language codes
+var iso639 = func() map[string]bool {
+	codes := make(map[string]bool)
+	for _, code := range strings.Fields(`
+		aa ab ae af ak am an ar as av ay az ba be bg bh bi bm bn bo br bs ca
+		ce ch co cr cs cu cv cy da de dv dz ee el en eo es et eu fa ff fi fj
+		fo fr fy ga gd gl gn gu gv ha he hi ho hr ht hu hy hz ia id ie ig ii
+		ik io is it iu ja jv ka kg ki kj kk kl km kn ko kr ks ku kv kw ky la
+		lb lg li ln lo lt lu lv mg mh mi mk ml mn mr ms mt my na nb nd ne ng
+		nl nn no nr nv ny oc oj om or os pa pi pl ps pt qu rm rn ro ru rw sa
+		sc sd se sg si sk sl sm sn so sq sr ss st su sv sw ta te tg th ti tk
+		tl tn to tr ts tt tw ty ug uk ur uz ve vi vo wa wo xh yi yo za zh zu`) {
+		codes[code] = true
+	}
+	return codes
+}()
+
+// inferLang returns the language tag in the name of file, if there is one
+func inferLang(file string) string {
+	parts := strings.Split(filepath.Base(file), ".")
+	if len(parts) < 3 {
+		return ""
+	}
+	tag := langSuffix.FindStringSubmatch(parts[len(parts)-2])
+	if tag == nil || !iso639[tag[1]] {
+		return ""
+	}
+	return tag[0]
+}
+
+// gemtextMIME returns the MIME type of gemtext files, and directory listings,
+// at urlPath, with the lang and charset parameters for it. file is the path
+// on the filesystem, if any.
+func (conf *Config) gemtextMIME(urlPath, file string) string {
+	options := conf.dirConfigFor(urlPath)
+	if conf.InferLang {
+		if lang := inferLang(file); lang != "" {
+			options.Lang = lang
+		}
+	}
+	meta := "text/gemini"
+	if options.Lang != "" {
+		meta += "; lang=" + options.Lang
+	}
+	if options.Charset != "" {
+		meta += "; charset=" + options.Charset
+	}
+	return meta
+}
@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestDirConfigFor(t *testing.T) {
+	conf := testConfig(t)
+	conf.Lang = "en"
+	conf.Charset = "utf-8"
+	conf.Directories = map[string]DirConfig{
+		"/de/":         {Lang: "de"},
+		"/de/latin1/":  {Charset: "iso-8859-1"},
+		"/fr/":         {Lang: "fr", Charset: "iso-8859-1"},
+		"/fr/archive/": {Lang: "fr-CA"},
+	}
+	for urlPath, want := range map[string]DirConfig{
+		"/index.gmi":            {Lang: "en", Charset: "utf-8"},
+		"/de/index.gmi":         {Lang: "de", Charset: "utf-8"},
+		"/de/latin1/index.gmi":  {Lang: "en", Charset: "iso-8859-1"},
+		"/fr/index.gmi":         {Lang: "fr", Charset: "iso-8859-1"},
+		"/fr/archive/index.gmi": {Lang: "fr-CA", Charset: "utf-8"},
+		"/french/index.gmi":     {Lang: "en", Charset: "utf-8"},
+	} {
+		// The directories are in a different order each time
+		for i := 0; i < 20; i++ {
+			if got := conf.dirConfigFor(urlPath); got != want {
+				t.Errorf("got %+v for %s, want %+v", got, urlPath, want)
+				break
+			}
+		}
+	}
+}
+
+func TestInferLang(t *testing.T) {
+	for file, want := range map[string]string{
+		"index.de.gmi":      "de",
+		"about.pt-BR.gmi":   "pt-BR",
+		"about.es-419.gmi":  "es-419",
+		"news.zh-Hant.gmi":  "zh-Hant",
+		"/srv/a.b/x.fr.gmi": "fr",
+		"index.gmi":         "",
+		"de.gmi":            "",
+		"notes.old.gmi":     "",
+		"notes.v2.gmi":      "",
+		"notes.xx.gmi":      "",
+		"notes.DE.gmi":      "",
+		"notes.de-br.gmi":   "",
+		"notes.eng.gmi":     "",
+		"notes.de-BR-x.gmi": "",
+	} {
+		if got := inferLang(file); got != want {
+			t.Errorf("inferLang(%q) = %q, want %q", file, got, want)
+		}
+	}
+}
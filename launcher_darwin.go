@@ -0,0 +1,32 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+)
+
+// There is no way to keep the right to switch users once the process has
+// switched to the User from the config, so user CGI scripts need spsrv to
+// run as root
+const canLaunchAsUsers = false
+
+type cgiLauncher struct{}
+
+var launcher *cgiLauncher
+
+func startCGILauncher() error {
+	return errors.New("user CGI scripts can't be run after switching users on this system")
+}
+
+func (l *cgiLauncher) keepCapabilities() error {
+	return nil
+}
+
+func startCGI(cmd *exec.Cmd) error {
+	return cmd.Start()
+}
+
+func killProcessGroup(pid int) {
+	syscall.Kill(-pid, syscall.SIGKILL)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// User CGI scripts can be run while the rest of spsrv runs as the User from
+// the config
+const canLaunchAsUsers = true
+
+const (
+	prSetKeepcaps           = 8
+	linuxCapabilityVersion3 = 0x20080522
+	capKill                 = 5
+	capSetgid               = 6
+	capSetuid               = 7
+)
+
+// cgiLauncher is an OS thread that keeps the capabilities needed to start
+// user CGI scripts as the users owning them, and to kill them, once the rest
+// of spsrv has dropped its privileges. Processes are forked from it so they
+// start off with its capabilities, which they lose when executing the script
+// as another user. The Go runtime never starts new threads from a locked
+// thread, so no other thread ends up with them.
+type cgiLauncher struct {
+	calls chan func()
+}
+
+// launcher is set when user CGI scripts are run through it
+var launcher *cgiLauncher
+
+// startCGILauncher starts the launcher thread. It must be called while still
+// root, before dropPrivileges, and followed by keepCapabilities after it.
+func startCGILauncher() error {
+	l := &cgiLauncher{calls: make(chan func())}
+	ready := make(chan error)
+	go func() {
+		// Never unlocked, so that the thread exits along with the goroutine
+		runtime.LockOSThread()
+		// Keep the capabilities of this thread when root is left behind
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetKeepcaps, 1, 0); errno != 0 {
+			ready <- fmt.Errorf("unable to keep capabilities: %w", errno)
+			return
+		}
+		ready <- nil
+		for call := range l.calls {
+			call()
+		}
+	}()
+	if err := <-ready; err != nil {
+		return err
+	}
+	launcher = l
+	return nil
+}
+
+// run calls f on the launcher thread
+func (l *cgiLauncher) run(f func() error) error {
+	done := make(chan error)
+	l.calls <- func() { done <- f() }
+	return <-done
+}
+
+// keepCapabilities drops every capability of the launcher thread except
+// those it needs, and makes them effective. It must be called once the
+// process has switched to its user.
+func (l *cgiLauncher) keepCapabilities() error {
+	return l.run(func() error {
+		header := struct {
+			version uint32
+			pid     int32
+		}{version: linuxCapabilityVersion3}
+		mask := uint32(1<<capKill | 1<<capSetgid | 1<<capSetuid)
+		data := [2]struct {
+			effective, permitted, inheritable uint32
+		}{{effective: mask, permitted: mask}}
+		_, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET,
+			uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0)
+		if errno != 0 {
+			return fmt.Errorf("unable to set capabilities: %w", errno)
+		}
+		return nil
+	})
+}
+
+// startCGI starts cmd, from the launcher thread for scripts run as another
+// user
+func startCGI(cmd *exec.Cmd) error {
+	if launcher == nil || cmd.SysProcAttr.Credential == nil {
+		return cmd.Start()
+	}
+	return launcher.run(cmd.Start)
+}
+
+// killProcessGroup kills the process group led by pid, from the launcher
+// thread if there is one as the processes may belong to another user
+func killProcessGroup(pid int) {
+	kill := func() error { return syscall.Kill(-pid, syscall.SIGKILL) }
+	if launcher == nil {
+		kill()
+		return
+	}
+	launcher.run(kill)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// localConfigName is the name of the files that override options for the
+// directory they are in and everything under it, much like .htaccess
+const localConfigName = ".spsrv"
+
+// LocalConfig is the content of a .spsrv file. Options left out are taken
+// from the .spsrv files of the directories above it, then from the config.
+type LocalConfig struct {
+	DirlistEnable  *bool
+	DirlistReverse *bool
+	DirlistSort    string
+	DirlistTitles  *bool
+	IndexFile      string
+	Lang           string
+	Charset        string
+	MIMETypes      map[string]string
+	Redirects      map[string]string // Path relative to the directory to where it moved
+	Access         []AccessRule      // For requests under the directory
+}
+
+func (local *LocalConfig) validate() error {
+	if local.DirlistSort != "" && local.DirlistSort != "name" && local.DirlistSort != "time" && local.DirlistSort != "size" {
+		return fmt.Errorf("dirlistSort %q is not one of name/time/size", local.DirlistSort)
+	}
+	if strings.Contains(local.IndexFile, "/") {
+		return fmt.Errorf("indexFile %q must be a file name", local.IndexFile)
+	}
+	mimeTypes := make(map[string]string)
+	for ext, mimeType := range local.MIMETypes {
+		mimeTypes[normaliseExt(ext)] = mimeType
+	}
+	local.MIMETypes = mimeTypes
+	for name, target := range local.Redirects {
+		if strings.Contains(name, "..") {
+			return fmt.Errorf("redirect from %q must not contain ..", name)
+		}
+		if _, err := url.Parse(target); err != nil {
+			return fmt.Errorf("redirect from %q: %w", name, err)
+		}
+	}
+	for i := range local.Access {
+		if local.Access[i].Path != "" || local.Access[i].User != "" {
+			return errors.New("[[access]] rules can't set path or user, they apply to the directory they are in")
+		}
+		if err := local.Access[i].validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// localConfigCache keeps the .spsrv files read so far, so that each one is
+// only parsed again once it changes.
+type localConfigCache struct {
+	mu    sync.Mutex
+	files map[string]*cachedLocalConfig
+}
+
+type cachedLocalConfig struct {
+	modTime time.Time
+	size    int64
+	local   *LocalConfig
+}
+
+var localConfigs = &localConfigCache{files: make(map[string]*cachedLocalConfig)}
+
+// read returns the .spsrv file at path, or nil if there is none
+func (c *localConfigCache) read(path string) (*LocalConfig, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+		c.mu.Lock()
+		delete(c.files, path)
+		c.mu.Unlock()
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	cached, ok := c.files[path]
+	c.mu.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.local, nil
+	}
+
+	var local LocalConfig
+	if _, err := toml.DecodeFile(path, &local); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := local.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	c.mu.Lock()
+	c.files[path] = &cachedLocalConfig{modTime: info.ModTime(), size: info.Size(), local: &local}
+	c.mu.Unlock()
+	return &local, nil
+}
+
+// withLocalConfig applies the .spsrv files of root, which is served at
+// rootURL, and of each directory under it down to dir, from the root to the
+// leaf. dir is relative to root. conf is returned as it is if there are no
+// such files, otherwise the options are applied to a copy of it.
+func (conf *Config) withLocalConfig(root, rootURL, dir string) (*Config, error) {
+	var parts []string
+	if dir != "" && dir != "." {
+		parts = strings.Split(dir, "/")
+	}
+	merged := conf
+	fsDir, urlDir := root, rootURL
+	for i := 0; i <= len(parts); i++ {
+		if i > 0 {
+			fsDir = filepath.Join(fsDir, parts[i-1])
+			urlDir += parts[i-1] + "/"
+		}
+		local, err := localConfigs.read(filepath.Join(fsDir, localConfigName))
+		if err != nil {
+			return nil, err
+		}
+		if local == nil {
+			continue
+		}
+		if merged == conf {
+			c := *conf
+			c.local = &LocalConfig{}
+			merged = &c
+		}
+		merged.applyLocalConfig(local, urlDir)
+	}
+	return merged, nil
+}
+
+// applyLocalConfig sets the options of a .spsrv file in the directory served
+// at urlDir. Options that have a counterpart in the config replace it, the
+// rest are gathered in conf.local.
+func (conf *Config) applyLocalConfig(local *LocalConfig, urlDir string) {
+	if local.DirlistEnable != nil {
+		conf.DirlistEnable = *local.DirlistEnable
+	}
+	if local.DirlistReverse != nil {
+		conf.DirlistReverse = *local.DirlistReverse
+	}
+	if local.DirlistSort != "" {
+		conf.DirlistSort = local.DirlistSort
+	}
+	if local.DirlistTitles != nil {
+		conf.DirlistTitles = *local.DirlistTitles
+	}
+	if local.IndexFile != "" {
+		conf.IndexFile = local.IndexFile
+	}
+	if local.Lang != "" {
+		conf.local.Lang = local.Lang
+	}
+	if local.Charset != "" {
+		conf.local.Charset = local.Charset
+	}
+	if len(local.MIMETypes) != 0 {
+		// conf.mimeTypes may be shared with the config it was copied from
+		mimeTypes := make(map[string]string)
+		for ext, mimeType := range conf.mimeTypes {
+			mimeTypes[ext] = mimeType
+		}
+		for ext, mimeType := range local.MIMETypes {
+			mimeTypes[ext] = mimeType
+		}
+		conf.mimeTypes = mimeTypes
+	}
+	for name, target := range local.Redirects {
+		if conf.local.Redirects == nil {
+			conf.local.Redirects = make(map[string]string)
+		}
+		// Relative targets are relative to the directory too
+		ref, _ := url.Parse(target)
+		target = (&url.URL{Path: urlDir}).ResolveReference(ref).String()
+		conf.local.Redirects[urlDir+strings.TrimPrefix(name, "/")] = target
+	}
+	for _, rule := range local.Access {
+		rule.Path = urlDir
+		conf.local.Access = append(conf.local.Access, rule)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeFiles creates files under root with the given contents
+func writeFiles(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLocalConfigOverride(t *testing.T) {
+	conf := testConfig(t)
+	writeFiles(t, conf.RootDir, map[string]string{
+		".spsrv":               "lang=\"fr\"\ncharset=\"iso-8859-1\"\n",
+		"page.gmi":             "",
+		"sub/.spsrv":           "lang=\"de\"\nindexFile=\"start.gmi\"\n",
+		"sub/page.gmi":         "",
+		"sub/start.gmi":        "start\n",
+		"sub/deeper/page.gmi":  "",
+		"sub/deeper/start.gmi": "deeper\n",
+		"other/page.gmi":       "",
+	})
+	for _, test := range []struct {
+		path, response string
+	}{
+		{"/page.gmi", "2 text/gemini; lang=fr; charset=iso-8859-1\r\n"},
+		{"/other/page.gmi", "2 text/gemini; lang=fr; charset=iso-8859-1\r\n"},
+		// The deeper file wins, for the options it sets
+		{"/sub/page.gmi", "2 text/gemini; lang=de; charset=iso-8859-1\r\n"},
+		{"/sub/", "2 text/gemini; lang=de; charset=iso-8859-1\r\nstart\n"},
+		// and for directories below it
+		{"/sub/deeper/page.gmi", "2 text/gemini; lang=de; charset=iso-8859-1\r\n"},
+		{"/sub/deeper/", "2 text/gemini; lang=de; charset=iso-8859-1\r\ndeeper\n"},
+	} {
+		if response := doRequest(t, conf, "localhost "+test.path+" 0", ""); response != test.response {
+			t.Errorf("%s: got response %q, want %q", test.path, response, test.response)
+		}
+	}
+}
+
+func TestLocalConfigReread(t *testing.T) {
+	conf := testConfig(t)
+	writeFiles(t, conf.RootDir, map[string]string{
+		".spsrv":   "lang=\"fr\"\n",
+		"page.gmi": "",
+	})
+	check := func(want string) {
+		t.Helper()
+		if response := doRequest(t, conf, "localhost /page.gmi 0", ""); response != want {
+			t.Errorf("got response %q, want %q", response, want)
+		}
+	}
+	check("2 text/gemini; lang=fr; charset=utf-8\r\n")
+
+	// Same size, so only the modification time tells it changed
+	path := filepath.Join(conf.RootDir, ".spsrv")
+	writeFiles(t, conf.RootDir, map[string]string{".spsrv": "lang=\"de\"\n"})
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	check("2 text/gemini; lang=de; charset=utf-8\r\n")
+
+	writeFiles(t, conf.RootDir, map[string]string{".spsrv": "lang=\"pt-BR\"\n"})
+	check("2 text/gemini; lang=pt-BR; charset=utf-8\r\n")
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	check("2 text/gemini; lang=en; charset=utf-8\r\n")
+}
+
+func TestLocalConfigRedirects(t *testing.T) {
+	conf := testConfig(t)
+	writeFiles(t, conf.RootDir, map[string]string{
+		"sub/.spsrv": `
+[redirects]
+"old.gmi" = "new.gmi"
+"/slash.gmi" = "../up.gmi"
+"dir/" = "/elsewhere/"
+"gone.gmi" = "spartan://example.net/gone.gmi"
+`,
+	})
+	for _, test := range []struct {
+		path, response string
+	}{
+		{"/sub/old.gmi", "3 /sub/new.gmi\r\n"},
+		{"/sub/slash.gmi", "3 /up.gmi\r\n"},
+		{"/sub/dir/", "3 /elsewhere/\r\n"},
+		{"/sub/gone.gmi", "3 spartan://example.net/gone.gmi\r\n"},
+		// Keyed relative to the directory of the file only
+		{"/old.gmi", "4 Not found\r\n"},
+		{"/sub/sub/old.gmi", "4 Not found\r\n"},
+	} {
+		if response := doRequest(t, conf, "localhost "+test.path+" 0", ""); response != test.response {
+			t.Errorf("%s: got response %q, want %q", test.path, response, test.response)
+		}
+	}
+
+	// The same file in a user directory
+	local, err := conf.withLocalConfig(conf.RootDir, "/~alice/", "sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for from, want := range map[string]string{
+		"/~alice/sub/old.gmi":   "/~alice/sub/new.gmi",
+		"/~alice/sub/slash.gmi": "/~alice/up.gmi",
+		"/~alice/sub/dir/":      "/elsewhere/",
+		"/~alice/sub/gone.gmi":  "spartan://example.net/gone.gmi",
+	} {
+		if target := local.local.Redirects[from]; target != want {
+			t.Errorf("got redirect from %s to %q, want %q", from, target, want)
+		}
+	}
+	if len(local.local.Redirects) != 4 {
+		t.Errorf("got redirects %v, want 4", local.local.Redirects)
+	}
+}
+
+func TestLocalConfigAccess(t *testing.T) {
+	conf := testConfig(t)
+	writeFiles(t, conf.RootDir, map[string]string{
+		"page.gmi":            "page\n",
+		"sub/.spsrv":          "[[access]]\ndeny=[\"127.0.0.0/8\"]\n",
+		"sub/page.gmi":        "page\n",
+		"sub/deeper/page.gmi": "page\n",
+		"subway/page.gmi":     "page\n",
+	})
+	for _, test := range []struct {
+		path, response string
+	}{
+		{"/page.gmi", "2 text/gemini; lang=en; charset=utf-8\r\npage\n"},
+		{"/subway/page.gmi", "2 text/gemini; lang=en; charset=utf-8\r\npage\n"},
+		{"/sub/page.gmi", "4 Access denied\r\n"},
+		{"/sub/deeper/page.gmi", "4 Access denied\r\n"},
+		{"/sub/", "4 Access denied\r\n"},
+	} {
+		if response := doRequest(t, conf, "localhost "+test.path+" 0", ""); response != test.response {
+			t.Errorf("%s: got response %q, want %q", test.path, response, test.response)
+		}
+	}
+
+	local, err := conf.withLocalConfig(conf.RootDir, "/~alice/", "sub/deeper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(local.local.Access) != 1 || local.local.Access[0].Path != "/~alice/sub/" {
+		t.Errorf("got access rules %+v, want one for /~alice/sub/", local.local.Access)
+	}
+	if len(conf.Access) != 0 {
+		t.Errorf("the rules of the .spsrv file were added to the config: %+v", conf.Access)
+	}
+}
+
+func TestLocalConfigInvalid(t *testing.T) {
+	for _, test := range []struct {
+		name, content, err string
+	}{
+		{"path", "[[access]]\npath=\"/other/\"\ndeny=[\"192.0.2.0/24\"]\n", "[[access]] rules can't set path or user"},
+		{"user", "[[access]]\nuser=\"alice\"\ndeny=[\"192.0.2.0/24\"]\n", "[[access]] rules can't set path or user"},
+		{"network", "[[access]]\ndeny=[\"192.0.2.0/33\"]\n", "192.0.2.0/33"},
+		{"syntax", "lang=\n", "toml"},
+		{"type", "lang=1\n", "toml"},
+		{"sort", "dirlistSort=\"color\"\n", "dirlistSort"},
+	} {
+		conf := testConfig(t)
+		writeFiles(t, conf.RootDir, map[string]string{
+			"sub/.spsrv":   test.content,
+			"sub/page.gmi": "page\n",
+			"page.gmi":     "page\n",
+		})
+		path := filepath.Join(conf.RootDir, "sub", ".spsrv")
+		if _, err := localConfigs.read(path); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got error %v, want one about %s", test.name, err, test.err)
+		}
+		if response := doRequest(t, conf, "localhost /sub/page.gmi 0", ""); response != "5 Error in directory config\r\n" {
+			t.Errorf("%s: got response %q", test.name, response)
+		}
+		// Only requests under the directory are affected
+		if response := doRequest(t, conf, "localhost /page.gmi 0", ""); response != "2 text/gemini; lang=en; charset=utf-8\r\npage\n" {
+			t.Errorf("%s: got response %q for a file outside the directory", test.name, response)
+		}
+	}
+}
+
+func TestLocalConfigNotServed(t *testing.T) {
+	conf := testConfig(t)
+	conf.DirlistEnable = true
+	writeFiles(t, conf.RootDir, map[string]string{
+		".spsrv":     "lang=\"en\"\n",
+		"sub/.spsrv": "lang=\"en\"\n",
+	})
+	for _, path := range []string{"/.spsrv", "/sub/.spsrv", "//sub/./.spsrv"} {
+		if response := doRequest(t, conf, "localhost "+path+" 0", ""); response != "4 Not found\r\n" {
+			t.Errorf("%s: got response %q", path, response)
+		}
+	}
+	// Nor listed
+	if response := doRequest(t, conf, "localhost /sub/ 0", ""); !strings.HasPrefix(response, "2 ") || strings.Contains(response, localConfigName) {
+		t.Errorf("got directory listing %q", response)
+	}
+}
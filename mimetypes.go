@@ -0,0 +1,76 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// builtinMIMETypes covers common files in capsules that the system
+// mime.types file, if there is one, and Go's own table may not know about.
+var builtinMIMETypes = map[string]string{
+	".txt":      "text/plain; charset=utf-8",
+	".md":       "text/markdown; charset=utf-8",
+	".markdown": "text/markdown; charset=utf-8",
+	".csv":      "text/csv; charset=utf-8",
+	".atom":     "application/atom+xml",
+	".rss":      "application/rss+xml",
+	".epub":     "application/epub+zip",
+	".gz":       "application/gzip",
+	".tar":      "application/x-tar",
+	".xz":       "application/x-xz",
+	".zip":      "application/zip",
+	".iso":      "application/x-iso9660-image",
+	".opus":     "audio/opus",
+	".ogg":      "audio/ogg",
+	".oga":      "audio/ogg",
+	".flac":     "audio/flac",
+	".mp3":      "audio/mpeg",
+	".wav":      "audio/wav",
+	".mp4":      "video/mp4",
+	".webm":     "video/webm",
+}
+
+// compileMIMETypes normalises the extensions of the [mimetypes] table to
+// lower case with a leading dot.
+func (conf *Config) compileMIMETypes() {
+	conf.mimeTypes = make(map[string]string)
+	for ext, mimeType := range conf.MIMETypes {
+		conf.mimeTypes[normaliseExt(ext)] = mimeType
+	}
+}
+
+// normaliseExt returns ext in lower case, with a leading dot
+func normaliseExt(ext string) string {
+	ext = strings.ToLower(ext)
+	if !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	return ext
+}
+
+// contentType returns the MIME type to send for the file at path, requested as
+// urlPath, given the start of its content. The extension is looked up in the
+// [mimetypes] table, then the system and built-in tables, and only if none of
+// them know it is the content sniffed.
+func contentType(conf *Config, urlPath, path string, head []byte) string {
+	if strings.HasSuffix(path, "/") {
+		// Directory listings
+		return conf.gemtextMIME(urlPath, "")
+	}
+	ext := strings.ToLower(filepath.Ext(path))
+	if mimeType, ok := conf.mimeTypes[ext]; ok {
+		return mimeType
+	}
+	if ext == ".gmi" || ext == ".gemini" {
+		return conf.gemtextMIME(urlPath, path)
+	}
+	if mimeType := mime.TypeByExtension(ext); mimeType != "" {
+		return mimeType
+	}
+	if mimeType, ok := builtinMIMETypes[ext]; ok {
+		return mimeType
+	}
+	return http.DetectContentType(head)
+}
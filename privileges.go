@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges switches the process to the User and Group from the config.
+// Supplementary groups are cleared. It does nothing if neither is set. The
+// ids are changed for every thread of the process, which Go only does since
+// 1.16: before that, syscall.Setuid and Setgid always fail on Linux.
+func dropPrivileges(conf *Config) error {
+	if conf.User == "" && conf.Group == "" {
+		return nil
+	}
+	uid, gid := -1, -1
+	if conf.User != "" {
+		u, err := user.Lookup(conf.User)
+		if err != nil {
+			return err
+		}
+		if uid, err = strconv.Atoi(u.Uid); err != nil {
+			return fmt.Errorf("invalid uid %q for user %s", u.Uid, conf.User)
+		}
+		// The primary group of the user, unless Group says otherwise
+		if gid, err = strconv.Atoi(u.Gid); err != nil {
+			return fmt.Errorf("invalid gid %q for user %s", u.Gid, conf.User)
+		}
+	}
+	if conf.Group != "" {
+		g, err := user.LookupGroup(conf.Group)
+		if err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return fmt.Errorf("invalid gid %q for group %s", g.Gid, conf.Group)
+		}
+	}
+
+	// The order matters: once the uid is changed, we are no longer allowed
+	// to change groups.
+	if err := syscall.Setgroups([]int{}); err != nil && os.Getuid() == 0 {
+		return fmt.Errorf("unable to clear supplementary groups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("unable to change group to %d: %w", gid, err)
+	}
+	if uid != -1 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("unable to change user to %d: %w", uid, err)
+		}
+	}
+
+	// Make sure there is no way back
+	if uid != -1 && uid != 0 && (os.Getuid() != uid || os.Geteuid() != uid || syscall.Setuid(0) == nil) {
+		return fmt.Errorf("user is still %d after changing to %d", os.Geteuid(), uid)
+	}
+	if os.Getgid() != gid || os.Getegid() != gid {
+		return fmt.Errorf("group is still %d after changing to %d", os.Getegid(), gid)
+	}
+	log.Printf("Running as uid %d, gid %d", os.Getuid(), os.Getgid())
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// ProxyRoute passes requests under Path on to another spartan server
+type ProxyRoute struct {
+	Path     string
+	Upstream string // spartan://host:port/path
+	BackendTimeouts
+
+	upstream *url.URL
+}
+
+func (route *ProxyRoute) validate() error {
+	if !strings.HasPrefix(route.Path, "/") {
+		return fmt.Errorf("proxy path %q must start with /", route.Path)
+	}
+	upstream, err := url.Parse(route.Upstream)
+	if err != nil {
+		return fmt.Errorf("invalid upstream for proxy route %s: %w", route.Path, err)
+	}
+	if upstream.Scheme != "spartan" || upstream.Host == "" {
+		return fmt.Errorf("upstream for proxy route %s must be a spartan:// URL with a host", route.Path)
+	}
+	if upstream.Port() == "" {
+		upstream.Host = net.JoinHostPort(upstream.Hostname(), "300")
+	}
+	if upstream.Path == "" {
+		upstream.Path = "/"
+	}
+	route.upstream = upstream
+	route.BackendTimeouts.setDefaults()
+	return nil
+}
+
+// proxyRouteFor returns the first proxy route reqPath is under, if any
+func (conf *Config) proxyRouteFor(reqPath string) *ProxyRoute {
+	for i := range conf.Proxy {
+		if _, ok := matchMount(conf.Proxy[i].Path, reqPath); ok {
+			return &conf.Proxy[i]
+		}
+	}
+	return nil
+}
+
+func handleProxy(req *Request, route *ProxyRoute) {
+	conn := req.conn
+	rest, _ := matchMount(route.Path, req.path)
+	if rest == "" && strings.HasSuffix(route.upstream.Path, "/") {
+		// /folder to /folder/ redirect, so that relative links in what the
+		// upstream serves there resolve under the mount point
+		log.Println("Redirecting", req.path, "to", req.path+"/")
+		sendResponseHeader(conn, statusRedirect, (&url.URL{Path: req.path + "/"}).EscapedPath())
+		return
+	}
+	upstreamPath := strings.TrimSuffix(route.upstream.Path, "/") + rest
+	if upstreamPath == "" {
+		upstreamPath = "/"
+	}
+	target := (&url.URL{Path: upstreamPath}).EscapedPath()
+	if req.query != "" {
+		target += "?" + req.query
+	}
+	readTimeout := route.readTimeout()
+
+	log.Println("Passing request to spartan upstream:", route.Upstream)
+	upstream, err := net.DialTimeout("tcp", route.upstream.Host, route.connectTimeout())
+	if err != nil {
+		log.Println("Error connecting to spartan upstream:", err.Error())
+		sendResponseHeader(conn, statusServerError, "Upstream unavailable")
+		return
+	}
+	defer upstream.Close()
+
+	w := &deadlineWriter{upstream, readTimeout}
+	_, err = fmt.Fprintf(w, "%s %s %d\r\n", route.upstream.Hostname(), target, req.dataLen)
+	if err == nil {
+		_, err = io.Copy(w, req.data)
+	}
+	if err != nil && req.data.timedOutReading() {
+		sendResponseHeader(conn, statusClientError, "Timed out reading data block")
+		return
+	}
+	if err != nil {
+		log.Println("Error sending request to spartan upstream:", err.Error())
+		sendResponseHeader(conn, statusServerError, "Upstream error")
+		return
+	}
+
+	output := bufio.NewReaderSize(&deadlineReader{upstream, readTimeout}, maxHeaderLength)
+	header, err := readResponseHeader(output)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		log.Println("Timed out waiting for spartan upstream", route.Upstream)
+		sendResponseHeader(conn, statusServerError, "Upstream timed out")
+		return
+	}
+	if err != nil {
+		log.Println("Unable to parse response header from spartan upstream " + route.Upstream + ": " + err.Error() + ". Line was: " + strings.TrimRight(string(header), "\r\n"))
+		sendResponseHeader(conn, statusServerError, "Upstream error")
+		return
+	}
+	if header[0] == '0'+statusRedirect {
+		meta := strings.TrimRight(string(header[2:]), "\r\n")
+		if location, ok := route.rewriteRedirect(meta); ok {
+			log.Println("Rewriting upstream redirect from", meta, "to", location)
+			header = []byte(fmt.Sprintf("%d %s\r\n", statusRedirect, location))
+		}
+	}
+
+	log.Println("Returning upstream response")
+	if _, err = conn.Write(header); err == nil {
+		_, err = io.Copy(conn, output)
+	}
+	if err != nil {
+		log.Println("Error relaying upstream response:", err.Error())
+	}
+}
+
+// rewriteRedirect maps a redirect sent by the upstream to a path under the
+// mount point of the route. Redirects to paths outside of the upstream path,
+// or to other servers, are left alone.
+func (route *ProxyRoute) rewriteRedirect(location string) (string, bool) {
+	target, err := url.Parse(location)
+	if err != nil {
+		return "", false
+	}
+	if target.Scheme != "" || target.Host != "" {
+		if target.Scheme != "spartan" || target.Host != route.upstream.Host &&
+			!(route.upstream.Port() == "300" && target.Host == route.upstream.Hostname()) {
+			return "", false
+		}
+	} else if !strings.HasPrefix(target.Path, "/") {
+		// Relative redirects work the same under the mount point
+		return "", false
+	}
+	rest, ok := matchMount(route.upstream.Path, target.Path)
+	if !ok {
+		return "", false
+	}
+	rewritten := url.URL{Path: strings.TrimSuffix(route.Path, "/") + rest, RawQuery: target.RawQuery}
+	if rewritten.Path == "" {
+		rewritten.Path = "/"
+	}
+	return rewritten.String(), true
+}
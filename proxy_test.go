@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// proxyTestConfig returns a config mounting the /docs/ directory of another
+// in-process server under /wiki/
+func proxyTestConfig(t *testing.T) *Config {
+	t.Helper()
+	upstream := testConfig(t)
+	upstream.Hostname = ""
+	upstream.CGIPaths = []string{"docs/cgi/"}
+	upstream.Redirect = []RedirectRule{
+		{Path: "/docs/old.gmi", To: "/docs/page.gmi"},
+		{Path: "/docs/elsewhere.gmi", To: "/other/page.gmi"},
+		{Path: "/docs/moved.gmi", To: "spartan://example.net/docs/page.gmi"},
+	}
+	if err := upstream.validate(); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"docs/page.gmi":    "# Page\n",
+		"docs/sub/a.gmi":   "# A\n",
+		"docs/cgi/echo.sh": "#!/bin/sh\nprintf '2 text/plain\\r\\n'\necho \"$QUERY_STRING\"\ncat\n",
+	} {
+		path := filepath.Join(upstream.RootDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	conf := testConfig(t)
+	conf.Proxy = []ProxyRoute{{Path: "/wiki/", Upstream: "spartan://" + startServer(t, upstream) + "/docs/"}}
+	if err := conf.validate(); err != nil {
+		t.Fatal(err)
+	}
+	return conf
+}
+
+func TestProxy(t *testing.T) {
+	conf := proxyTestConfig(t)
+	for _, test := range []struct {
+		request, data, response string
+	}{
+		{"localhost /wiki/page.gmi 0", "", "2 text/gemini; lang=en; charset=utf-8\r\n# Page\n"},
+		{"localhost /wiki/sub/a.gmi 0", "", "2 text/gemini; lang=en; charset=utf-8\r\n# A\n"},
+		{"localhost /wiki/cgi/echo.sh?a=b%20c 5", "hello", "2 text/plain\r\na=b%20c\nhello"},
+		// The mount point itself, like a directory
+		{"localhost /wiki 0", "", "3 /wiki/\r\n"},
+		// Redirects from the upstream to paths under it
+		{"localhost /wiki/sub 0", "", "3 /wiki/sub/\r\n"},
+		{"localhost /wiki/old.gmi 0", "", "3 /wiki/page.gmi\r\n"},
+		// and elsewhere
+		{"localhost /wiki/elsewhere.gmi 0", "", "3 /other/page.gmi\r\n"},
+		{"localhost /wiki/moved.gmi 0", "", "3 spartan://example.net/docs/page.gmi\r\n"},
+	} {
+		if response := doRequest(t, conf, test.request, test.data); response != test.response {
+			t.Errorf("%q: got response %q, want %q", test.request, response, test.response)
+		}
+	}
+}
+
+func TestProxySlowDataBlock(t *testing.T) {
+	conf := proxyTestConfig(t)
+	conf.Proxy[0].ReadTimeout = 1
+	response := doSlowRequest(t, startServer(t, conf), "localhost /wiki/cgi/echo.sh 10", "helloworld", 1500*time.Millisecond)
+	if want := "2 text/plain\r\n\nhelloworld"; response != want {
+		t.Errorf("got response %q, want %q", response, want)
+	}
+}
+
+func TestProxyUpstreamDown(t *testing.T) {
+	conf := testConfig(t)
+	// Nothing listens on port 1
+	conf.Proxy = []ProxyRoute{{Path: "/wiki/", Upstream: "spartan://127.0.0.1:1/"}}
+	if err := conf.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if response := doRequest(t, conf, "localhost /wiki/page.gmi 0", ""); response != "5 Upstream unavailable\r\n" {
+		t.Errorf("got response %q", response)
+	}
+}
+
+func TestRewriteRedirect(t *testing.T) {
+	route := &ProxyRoute{Path: "/wiki/", Upstream: "spartan://upstream.example.org/docs/"}
+	if err := route.validate(); err != nil {
+		t.Fatal(err)
+	}
+	for location, want := range map[string]string{
+		"/docs/page.gmi":                        "/wiki/page.gmi",
+		"/docs":                                 "/wiki",
+		"/docs/?q=1":                            "/wiki/?q=1",
+		"/docs/a%20b.gmi":                       "/wiki/a%20b.gmi",
+		"spartan://upstream.example.org/docs/x": "/wiki/x",
+		"spartan://upstream.example.org:300/docs/x": "/wiki/x",
+		// Left alone
+		"/other/page.gmi": "",
+		"/docsx/page.gmi": "",
+		"page.gmi":        "",
+		"spartan://upstream.example.org:301/docs": "",
+		"spartan://example.net/docs/page.gmi":     "",
+		"gemini://upstream.example.org/docs/":     "",
+	} {
+		got, ok := route.rewriteRedirect(location)
+		if !ok {
+			got = ""
+		}
+		if got != want {
+			t.Errorf("rewriteRedirect(%q) = %q, %v, want %q", location, got, ok, want)
+		}
+	}
+}
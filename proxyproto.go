@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PROXY protocol headers are sent by relays such as HAProxy before the
+// request, to pass on the address of the client they accepted the
+// connection from.
+var (
+	proxyV1Prefix = []byte("PROXY ")
+	proxyV2Sig    = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const proxyV1MaxLine = 107
+
+// proxiedConn is a connection with the addresses taken from a PROXY
+// protocol header. Reads go through the buffer the header was read with.
+type proxiedConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxiedConn) Read(b []byte) (int, error) { return c.r.Read(b) }
+func (c *proxiedConn) RemoteAddr() net.Addr       { return c.remote }
+func (c *proxiedConn) LocalAddr() net.Addr        { return c.local }
+
+// readProxyHeader reads the PROXY protocol header conn must start with, and
+// returns a connection with the addresses from it. Headers are only accepted
+// from the trusted networks, and connections without one are refused.
+func readProxyHeader(conn net.Conn, conf *Config) (net.Conn, error) {
+	ip := net.ParseIP(remoteIP(conn))
+	trusted := false
+	for _, network := range conf.proxyTrusted {
+		if ip != nil && network.Contains(ip) {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		return nil, fmt.Errorf("%s is not a trusted PROXY protocol source", conn.RemoteAddr())
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Duration(conf.RequestTimeout) * time.Second))
+	pc := &proxiedConn{Conn: conn, r: bufio.NewReader(conn), remote: conn.RemoteAddr(), local: conn.LocalAddr()}
+	// Both versions are told apart by the first byte, so that connections
+	// without a header are refused without waiting for more
+	start, err := pc.r.Peek(1)
+	if err == nil && start[0] == proxyV2Sig[0] {
+		start, err = pc.r.Peek(len(proxyV2Sig))
+	} else if err == nil && start[0] == proxyV1Prefix[0] {
+		start, err = pc.r.Peek(len(proxyV1Prefix))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading PROXY protocol header: %w", err)
+	}
+	switch {
+	case bytes.Equal(start, proxyV2Sig):
+		err = pc.readV2()
+	case bytes.Equal(start, proxyV1Prefix):
+		err = pc.readV1()
+	default:
+		err = errors.New("connection does not start with a PROXY protocol header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// readV1 reads a header like "PROXY TCP4 192.0.2.1 192.0.2.2 56324 300\r\n"
+func (c *proxiedConn) readV1() error {
+	var line []byte
+	for len(line) < proxyV1MaxLine {
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("reading PROXY protocol header: %w", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return errors.New("PROXY protocol v1 header is too long")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		// The relay could not tell, the addresses of the connection are kept
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return fmt.Errorf("invalid PROXY protocol v1 header %q", line)
+	}
+	src, dst := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, err1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(fields[5], 10, 16)
+	if src == nil || dst == nil || err1 != nil || err2 != nil {
+		return fmt.Errorf("invalid PROXY protocol v1 header %q", line)
+	}
+	c.remote = &net.TCPAddr{IP: src, Port: int(srcPort)}
+	c.local = &net.TCPAddr{IP: dst, Port: int(dstPort)}
+	return nil
+}
+
+// readV2 reads a binary header: the signature, the version and command, the
+// address family and protocol, the length of the rest, and the addresses.
+func (c *proxiedConn) readV2() error {
+	var header [16]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return fmt.Errorf("reading PROXY protocol header: %w", err)
+	}
+	if header[12]>>4 != 2 {
+		return fmt.Errorf("unsupported PROXY protocol version %d", header[12]>>4)
+	}
+	addrs := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(c.r, addrs); err != nil {
+		return fmt.Errorf("reading PROXY protocol header: %w", err)
+	}
+	switch header[12] & 0xf {
+	case 0:
+		// LOCAL, such as health checks from the relay itself
+		return nil
+	case 1:
+		// PROXY, with the addresses below
+	default:
+		return fmt.Errorf("unsupported PROXY protocol command %d", header[12]&0xf)
+	}
+
+	var ipLen int
+	switch header[13] >> 4 {
+	case 1:
+		ipLen = net.IPv4len
+	case 2:
+		ipLen = net.IPv6len
+	default:
+		// UNSPEC or UNIX, the addresses of the connection are kept
+		return nil
+	}
+	if len(addrs) < 2*ipLen+4 {
+		return errors.New("PROXY protocol v2 addresses are too short")
+	}
+	c.remote = &net.TCPAddr{IP: net.IP(addrs[:ipLen]), Port: int(binary.BigEndian.Uint16(addrs[2*ipLen:]))}
+	c.local = &net.TCPAddr{IP: net.IP(addrs[ipLen : 2*ipLen]), Port: int(binary.BigEndian.Uint16(addrs[2*ipLen+2:]))}
+	return nil
+}
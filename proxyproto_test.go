@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2Header builds a binary header with the given command, address
+// family and addresses
+func proxyV2Header(command, family byte, addrs []byte) string {
+	header := append([]byte(nil), proxyV2Sig...)
+	header = append(header, 0x20|command, family<<4|1, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(addrs)))
+	return string(append(header, addrs...))
+}
+
+// proxyV2Addrs returns the addresses part of a binary header
+func proxyV2Addrs(src, dst string, srcPort, dstPort uint16) []byte {
+	srcIP, dstIP := net.ParseIP(src), net.ParseIP(dst)
+	if ip := srcIP.To4(); ip != nil {
+		srcIP, dstIP = ip, dstIP.To4()
+	}
+	addrs := append(append([]byte(nil), srcIP...), dstIP...)
+	return append(addrs, byte(srcPort>>8), byte(srcPort), byte(dstPort>>8), byte(dstPort))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	conf := testConfig(t)
+	conf.ProxyProtocol = true
+	conf.ProxyProtocolTrusted = []string{"127.0.0.0/8", "::1"}
+	if err := conf.validate(); err != nil {
+		t.Fatal(err)
+	}
+	const relay, request = "127.0.0.1", "localhost / 0\r\n"
+	// The addresses of the connection from the relay, kept when the header
+	// has none
+	const relayRemote, relayLocal = "127.0.0.1:40000", "pipe"
+
+	for _, test := range []struct {
+		name          string
+		from, header  string
+		remote, local string
+		err           string
+	}{
+		{
+			name:   "v1 TCP4",
+			from:   relay,
+			header: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 300\r\n",
+			remote: "192.0.2.1:56324", local: "198.51.100.1:300",
+		},
+		{
+			name:   "v1 TCP6",
+			from:   "::1",
+			header: "PROXY TCP6 2001:db8::1 2001:db8::2 56324 300\r\n",
+			remote: "[2001:db8::1]:56324", local: "[2001:db8::2]:300",
+		},
+		{
+			name:   "v1 UNKNOWN",
+			from:   relay,
+			header: "PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n",
+			remote: relayRemote, local: relayLocal,
+		},
+		{
+			name:   "v1 with missing fields",
+			from:   relay,
+			header: "PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n",
+			err:    "invalid PROXY protocol v1 header",
+		},
+		{
+			name:   "v1 with an invalid address",
+			from:   relay,
+			header: "PROXY TCP4 192.0.2.300 198.51.100.1 56324 300\r\n",
+			err:    "invalid PROXY protocol v1 header",
+		},
+		{
+			name:   "v1 with an invalid port",
+			from:   relay,
+			header: "PROXY TCP4 192.0.2.1 198.51.100.1 65536 300\r\n",
+			err:    "invalid PROXY protocol v1 header",
+		},
+		{
+			name:   "v1 line too long",
+			from:   relay,
+			header: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 300" + strings.Repeat(" ", proxyV1MaxLine) + "\r\n",
+			err:    "PROXY protocol v1 header is too long",
+		},
+		{
+			name:   "v1 cut short",
+			from:   relay,
+			header: "PROXY TCP4 192.0.2.1",
+			err:    "reading PROXY protocol header: EOF",
+		},
+		{
+			name:   "v2 PROXY IPv4",
+			from:   relay,
+			header: proxyV2Header(1, 1, proxyV2Addrs("192.0.2.1", "198.51.100.1", 56324, 300)),
+			remote: "192.0.2.1:56324", local: "198.51.100.1:300",
+		},
+		{
+			name:   "v2 PROXY IPv6",
+			from:   relay,
+			header: proxyV2Header(1, 2, proxyV2Addrs("2001:db8::1", "2001:db8::2", 56324, 300)),
+			remote: "[2001:db8::1]:56324", local: "[2001:db8::2]:300",
+		},
+		{
+			name: "v2 PROXY with TLVs after the addresses",
+			from: relay,
+			header: proxyV2Header(1, 1, append(proxyV2Addrs("192.0.2.1", "198.51.100.1", 56324, 300),
+				0x04, 0, 1, 0)),
+			remote: "192.0.2.1:56324", local: "198.51.100.1:300",
+		},
+		{
+			name:   "v2 LOCAL",
+			from:   relay,
+			header: proxyV2Header(0, 1, proxyV2Addrs("192.0.2.1", "198.51.100.1", 56324, 300)),
+			remote: relayRemote, local: relayLocal,
+		},
+		{
+			name:   "v2 LOCAL without addresses",
+			from:   relay,
+			header: proxyV2Header(0, 0, nil),
+			remote: relayRemote, local: relayLocal,
+		},
+		{
+			name:   "v2 unsupported command",
+			from:   relay,
+			header: proxyV2Header(2, 1, proxyV2Addrs("192.0.2.1", "198.51.100.1", 56324, 300)),
+			err:    "unsupported PROXY protocol command 2",
+		},
+		{
+			name:   "v2 unsupported version",
+			from:   relay,
+			header: string(proxyV2Sig) + "\x11\x11\x00\x00",
+			err:    "unsupported PROXY protocol version 1",
+		},
+		{
+			name:   "v2 addresses too short",
+			from:   relay,
+			header: proxyV2Header(1, 2, proxyV2Addrs("192.0.2.1", "198.51.100.1", 56324, 300)),
+			err:    "PROXY protocol v2 addresses are too short",
+		},
+		{
+			name:   "v2 cut short in the header",
+			from:   relay,
+			header: proxyV2Header(1, 1, nil)[:14],
+			err:    "reading PROXY protocol header: unexpected EOF",
+		},
+		{
+			name:   "v2 cut short in the addresses",
+			from:   relay,
+			header: proxyV2Header(1, 1, proxyV2Addrs("192.0.2.1", "198.51.100.1", 56324, 300))[:20],
+			err:    "reading PROXY protocol header: unexpected EOF",
+		},
+		{
+			name:   "v2 cut short in the signature",
+			from:   relay,
+			header: string(proxyV2Sig[:5]),
+			err:    "reading PROXY protocol header: EOF",
+		},
+		{
+			name:   "untrusted source",
+			from:   "192.0.2.1",
+			header: "PROXY TCP4 192.0.2.1 198.51.100.1 56324 300\r\n",
+			err:    "192.0.2.1:40000 is not a trusted PROXY protocol source",
+		},
+		{
+			name: "no header",
+			from: relay,
+			err:  "connection does not start with a PROXY protocol header",
+		},
+		{
+			name: "closed without sending anything",
+			from: relay,
+			err:  "reading PROXY protocol header: EOF",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conn, other := pipeFrom(t, test.from)
+			go func() {
+				other.Write([]byte(test.header))
+				if test.err == "" || test.name == "no header" {
+					other.Write([]byte(request))
+				}
+				other.Close()
+			}()
+
+			client, err := readProxyHeader(conn, conf)
+			if test.err != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+					t.Fatalf("got error %v, want %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if remote := client.RemoteAddr().String(); remote != test.remote {
+				t.Errorf("got remote address %s, want %s", remote, test.remote)
+			}
+			if local := client.LocalAddr().String(); local != test.local {
+				t.Errorf("got local address %s, want %s", local, test.local)
+			}
+			// The request is still there after the header
+			rest, _ := ioutil.ReadAll(client)
+			if string(rest) != request {
+				t.Errorf("got %q after the header, want %q", rest, request)
+			}
+		})
+	}
+}
+
+func TestServeProxyProtocol(t *testing.T) {
+	conf := testConfig(t)
+	conf.ProxyProtocol = true
+	conf.ProxyProtocolTrusted = []string{"127.0.0.1"}
+	conf.CGIPaths = []string{"cgi/"}
+	conf.Access = []AccessRule{{Deny: []string{"192.0.2.66"}}}
+	if err := conf.validate(); err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(conf.RootDir, "cgi", "addr.sh")
+	if err := os.Mkdir(filepath.Dir(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(script, []byte("#!/bin/sh\nprintf '2 text/plain\\r\\n%s %s' \"$REMOTE_ADDR\" \"$REMOTE_PORT\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(conf, map[string]net.Listener{"127.0.0.1:0": listener})
+	go srv.serveSpartan(listener)
+	defer srv.Shutdown(time.Second)
+
+	for _, test := range []struct {
+		name, header, response string
+	}{
+		{"v1", "PROXY TCP4 192.0.2.1 127.0.0.1 56324 300\r\n", "2 text/plain\r\n192.0.2.1 56324"},
+		{"v2", proxyV2Header(1, 1, proxyV2Addrs("192.0.2.2", "127.0.0.1", 56325, 300)), "2 text/plain\r\n192.0.2.2 56325"},
+		{"denied client", "PROXY TCP4 192.0.2.66 127.0.0.1 56324 300\r\n", "4 Access denied\r\n"},
+		// Refused without a response
+		{"no header", "", ""},
+	} {
+		client, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Write([]byte(test.header + "localhost /cgi/addr.sh 0\r\n"))
+		client.SetReadDeadline(time.Now().Add(10 * time.Second))
+		response, err := ioutil.ReadAll(client)
+		client.Close()
+		if err != nil {
+			t.Fatalf("%s: reading response: %s", test.name, err)
+		}
+		if string(response) != test.response {
+			t.Errorf("%s: got response %q, want %q", test.name, response, test.response)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// slowDown is the meta of the 5 response sent to clients over a limit. The
+// connection counts are checked when a connection is accepted, the request
+// rate once the request line is read, and the CGI rate before a script runs.
+const slowDown = "Slow down"
+
+// rateLimiter hands out requests to each remote IP from a token bucket, which
+// holds up to burst requests and is refilled with rate requests per second.
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastPrune time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+var (
+	requestLimiter = &rateLimiter{buckets: make(map[string]*bucket)}
+	cgiLimiter     = &rateLimiter{buckets: make(map[string]*bucket)}
+)
+
+// allow takes a request from the bucket of ip, and reports whether there was
+// one left. A rate of 0 means no limit.
+func (l *rateLimiter) allow(ip string, rate float64, burst int) bool {
+	if rate <= 0 {
+		return true
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune(now, rate, burst)
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &bucket{tokens: float64(burst), last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune forgets about buckets that have filled up again, at most once a
+// minute, so the map does not keep growing with every client ever seen.
+func (l *rateLimiter) prune(now time.Time, rate float64, burst int) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+	full := time.Duration(float64(burst) / rate * float64(time.Second))
+	for ip, b := range l.buckets {
+		if now.Sub(b.last) >= full {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// validateRateLimits checks the client limits and defaults the bursts to
+// the rate per second, rounded up.
+func (conf *Config) validateRateLimits() error {
+	if conf.MaxConnections < 0 || conf.MaxConnectionsPerIP < 0 {
+		return fmt.Errorf("MaxConnections and MaxConnectionsPerIP must not be negative")
+	}
+	for _, limit := range []struct {
+		name  string
+		rate  float64
+		burst *int
+	}{
+		{"RateLimit", conf.RateLimit, &conf.RateBurst},
+		{"CGIRateLimit", conf.CGIRateLimit, &conf.CGIRateBurst},
+	} {
+		if limit.rate < 0 || *limit.burst < 0 {
+			return fmt.Errorf("%s and its burst must not be negative", limit.name)
+		}
+		if limit.rate > 0 && *limit.burst == 0 {
+			*limit.burst = int(math.Ceil(limit.rate))
+		}
+	}
+	return nil
+}
+
+// remoteIP returns the IP address conn comes from
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// throttle counts a newly tracked conn as coming from client, which differs
+// from conn with the PROXY protocol, and checks the connection limits. It
+// returns why the connection is refused, if it is.
+func (srv *Server) throttle(conn, client net.Conn, conf *Config) string {
+	ip := remoteIP(client)
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.conns[conn] = ip
+	srv.perIP[ip]++
+	if conf.MaxConnections > 0 && len(srv.conns) > conf.MaxConnections {
+		return fmt.Sprintf("more than %d connections", conf.MaxConnections)
+	}
+	if conf.MaxConnectionsPerIP > 0 && srv.perIP[ip] > conf.MaxConnectionsPerIP {
+		return fmt.Sprintf("more than %d connections from the same IP", conf.MaxConnectionsPerIP)
+	}
+	return ""
+}
+
+// refuse answers a connection over the limits with a 5 response. The
+// request line is read first, if it comes quickly, as closing a connection
+// with data left unread could reset it before the client gets the response.
+func refuse(conn net.Conn, conf *Config) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	readRequestLine(bufio.NewReaderSize(conn, conf.MaxRequestLength+2))
+	sendResponseHeader(conn, statusServerError, slowDown)
+}
+
+// logThrottle logs a request refused because of a limit
+func logThrottle(ip, reason string) {
+	log.Println("Throttling " + ip + ": " + reason)
+}
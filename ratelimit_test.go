@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*bucket)}
+}
+
+func TestRateLimiterBurst(t *testing.T) {
+	l := newRateLimiter()
+	for i := 0; i < 3; i++ {
+		if !l.allow("192.0.2.1", 0.001, 3) {
+			t.Fatalf("request %d was refused within the burst of 3", i+1)
+		}
+	}
+	if l.allow("192.0.2.1", 0.001, 3) {
+		t.Error("a fourth request was allowed with a burst of 3")
+	}
+	// Each IP has its own bucket
+	if !l.allow("192.0.2.2", 0.001, 3) {
+		t.Error("another IP was refused")
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	l := newRateLimiter()
+	if !l.allow("192.0.2.1", 1, 1) || l.allow("192.0.2.1", 1, 1) {
+		t.Fatal("a burst of 1 allows exactly one request")
+	}
+	// As if a second has gone by
+	l.buckets["192.0.2.1"].last = l.buckets["192.0.2.1"].last.Add(-time.Second)
+	if !l.allow("192.0.2.1", 1, 1) {
+		t.Error("a request was refused after the bucket refilled")
+	}
+	// Refills never go over the burst
+	l.buckets["192.0.2.1"].last = l.buckets["192.0.2.1"].last.Add(-time.Hour)
+	if !l.allow("192.0.2.1", 1, 1) || l.allow("192.0.2.1", 1, 1) {
+		t.Error("the bucket was refilled past its burst")
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	l := newRateLimiter()
+	for i := 0; i < 100; i++ {
+		if !l.allow("192.0.2.1", 0, 0) {
+			t.Fatalf("request %d was refused with a rate of 0", i+1)
+		}
+	}
+	if len(l.buckets) != 0 {
+		t.Errorf("got %d buckets, want none without a limit", len(l.buckets))
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	l := newRateLimiter()
+	l.allow("192.0.2.1", 1, 10)
+	l.allow("192.0.2.2", 1, 10)
+	// 192.0.2.1 has filled up again since, 192.0.2.2 has not
+	l.buckets["192.0.2.1"].last = l.buckets["192.0.2.1"].last.Add(-time.Hour)
+	l.buckets["192.0.2.2"].last = l.buckets["192.0.2.2"].last.Add(-5 * time.Second)
+
+	// The last prune was too recent
+	l.allow("192.0.2.3", 1, 10)
+	if len(l.buckets) != 3 {
+		t.Fatalf("got %d buckets, want 3 before a minute has passed", len(l.buckets))
+	}
+
+	l.lastPrune = l.lastPrune.Add(-time.Minute)
+	l.allow("192.0.2.3", 1, 10)
+	if _, ok := l.buckets["192.0.2.1"]; ok {
+		t.Error("a full bucket was not pruned")
+	}
+	for _, ip := range []string{"192.0.2.2", "192.0.2.3"} {
+		if _, ok := l.buckets[ip]; !ok {
+			t.Errorf("the bucket of %s was pruned before filling up", ip)
+		}
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	conf := testConfig(t)
+	conf.MaxConnections = 3
+	conf.MaxConnectionsPerIP = 2
+	srv := NewServer(conf, nil)
+	accept := func(ip string) (net.Conn, string) {
+		conn, _ := pipeFrom(t, ip)
+		if !srv.track(conn) {
+			t.Fatal("the server refused to track a connection")
+		}
+		return conn, srv.throttle(conn, conn, conf)
+	}
+
+	first, reason := accept("192.0.2.1")
+	if reason != "" {
+		t.Fatalf("the first connection was refused: %s", reason)
+	}
+	if _, reason := accept("192.0.2.1"); reason != "" {
+		t.Fatalf("the second connection from an IP was refused: %s", reason)
+	}
+	third, reason := accept("192.0.2.1")
+	if reason != "more than 2 connections from the same IP" {
+		t.Errorf("got %q for a third connection from an IP", reason)
+	}
+	srv.untrack(third)
+	if _, reason := accept("192.0.2.2"); reason != "" {
+		t.Errorf("a connection from another IP was refused: %s", reason)
+	}
+	if _, reason := accept("192.0.2.3"); reason != "more than 3 connections" {
+		t.Errorf("got %q for a fourth connection overall", reason)
+	}
+
+	// Refused connections are still counted until untracked
+	if srv.perIP["192.0.2.3"] != 1 {
+		t.Errorf("got %d connections counted from 192.0.2.3, want 1", srv.perIP["192.0.2.3"])
+	}
+	srv.untrack(first)
+	if srv.perIP["192.0.2.1"] != 1 {
+		t.Errorf("got %d connections counted from 192.0.2.1 after closing one, want 1", srv.perIP["192.0.2.1"])
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// RedirectRule answers the requests it matches with a 3 response. Exactly
+// one of Path, Prefix and Regex is set, and is matched against the requested
+// path.
+type RedirectRule struct {
+	Path   string // Only this path
+	Prefix string // This path or anything under it, which is kept after To
+	// Regex is matched against the path as sent, percent-encoded. It may
+	// have capture groups, which are expanded in To as $1 or ${name}.
+	Regex string
+	// To is a path, or a URL such as spartan://example.org/ for another host
+	To string
+
+	regex *regexp.Regexp
+}
+
+func (rule *RedirectRule) String() string {
+	switch {
+	case rule.regex != nil:
+		return "regex " + rule.Regex
+	case rule.Prefix != "":
+		return fmt.Sprintf("prefix %q", rule.Prefix)
+	default:
+		return fmt.Sprintf("path %q", rule.Path)
+	}
+}
+
+func (rule *RedirectRule) validate() error {
+	n := 0
+	for _, pattern := range []string{rule.Path, rule.Prefix, rule.Regex} {
+		if pattern != "" {
+			n++
+		}
+	}
+	if n != 1 {
+		return errors.New("every [[redirect]] must set exactly one of path, prefix and regex")
+	}
+	if rule.Path != "" && !strings.HasPrefix(rule.Path, "/") {
+		return fmt.Errorf("[[redirect]] path %q must start with /", rule.Path)
+	}
+	if rule.Prefix != "" && !strings.HasPrefix(rule.Prefix, "/") {
+		return fmt.Errorf("[[redirect]] prefix %q must start with /", rule.Prefix)
+	}
+	rule.regex = nil
+	if rule.Regex != "" {
+		regex, err := regexp.Compile(rule.Regex)
+		if err != nil {
+			return fmt.Errorf("invalid [[redirect]] regex %q: %w", rule.Regex, err)
+		}
+		rule.regex = regex
+	}
+	if rule.To == "" {
+		return fmt.Errorf("[[redirect]] rule for %s must set to", rule)
+	}
+	if _, err := url.Parse(rule.To); err != nil {
+		return fmt.Errorf("[[redirect]] rule for %s: %w", rule, err)
+	}
+	return nil
+}
+
+// target returns where reqPath is redirected to, if the rule matches it
+func (rule *RedirectRule) target(reqPath string) (string, bool) {
+	switch {
+	case rule.regex != nil:
+		// Matched as sent, so that the groups are still escaped
+		escaped := (&url.URL{Path: reqPath}).EscapedPath()
+		match := rule.regex.FindStringSubmatchIndex(escaped)
+		if match == nil {
+			return "", false
+		}
+		return string(rule.regex.ExpandString(nil, rule.To, escaped, match)), true
+	case rule.Prefix != "":
+		rest, ok := matchMount(rule.Prefix, reqPath)
+		if !ok {
+			return "", false
+		}
+		return strings.TrimSuffix(rule.To, "/") + (&url.URL{Path: rest}).EscapedPath(), true
+	default:
+		return rule.To, reqPath == rule.Path
+	}
+}
+
+// redirectFor returns where the first [[redirect]] rule that matches the
+// request sends it, if any. The query string is passed on.
+func (conf *Config) redirectFor(req *Request) (string, *RedirectRule) {
+	for i := range conf.Redirect {
+		rule := &conf.Redirect[i]
+		target, ok := rule.target(req.path)
+		if !ok {
+			continue
+		}
+		u, err := url.Parse(target)
+		if err != nil {
+			log.Printf("Invalid target %q for [[redirect]] rule for %s: %s", target, rule, err)
+			continue
+		}
+		if req.query != "" && u.RawQuery == "" {
+			u.RawQuery = req.query
+		}
+		return u.String(), rule
+	}
+	return "", nil
+}
@@ -0,0 +1,4 @@
+package main
+
+// RLIMIT_NPROC is missing from the syscall package
+const rlimitNproc = 0x6
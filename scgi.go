@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SCGIRoute passes requests under Path on to the SCGI backend at Address
+type SCGIRoute struct {
+	Path    string
+	Address string // host:port, or unix:/path/to/socket
+	BackendTimeouts
+}
+
+func (route *SCGIRoute) validate() error {
+	if !strings.HasPrefix(route.Path, "/") {
+		return fmt.Errorf("SCGI path %q must start with /", route.Path)
+	}
+	if route.Address == "" {
+		return fmt.Errorf("SCGI route for %s must have an address", route.Path)
+	}
+	route.BackendTimeouts.setDefaults()
+	return nil
+}
+
+// BackendTimeouts are the timeouts of routes to backends and upstreams
+type BackendTimeouts struct {
+	ConnectTimeout int // Seconds
+	ReadTimeout    int // Seconds to wait for the backend to send or take more data
+}
+
+func (t *BackendTimeouts) setDefaults() {
+	if t.ConnectTimeout <= 0 {
+		t.ConnectTimeout = 5
+	}
+	if t.ReadTimeout <= 0 {
+		t.ReadTimeout = 30
+	}
+}
+
+func (t *BackendTimeouts) connectTimeout() time.Duration {
+	return time.Duration(t.ConnectTimeout) * time.Second
+}
+
+func (t *BackendTimeouts) readTimeout() time.Duration {
+	return time.Duration(t.ReadTimeout) * time.Second
+}
+
+// matchMount checks whether reqPath is mount or under it, and returns the rest
+// of reqPath after it.
+func matchMount(mount, reqPath string) (rest string, ok bool) {
+	mount = strings.TrimSuffix(mount, "/")
+	if reqPath == mount || strings.HasPrefix(reqPath, mount+"/") {
+		return reqPath[len(mount):], true
+	}
+	return "", false
+}
+
+// scgiRouteFor returns the first SCGI route reqPath is under, if any
+func (conf *Config) scgiRouteFor(reqPath string) *SCGIRoute {
+	for i := range conf.SCGI {
+		if _, ok := matchMount(conf.SCGI[i].Path, reqPath); ok {
+			return &conf.SCGI[i]
+		}
+	}
+	return nil
+}
+
+// dialBackend connects to a gateway backend given as host:port or
+// unix:/path/to/socket
+func dialBackend(address string, timeout time.Duration) (net.Conn, error) {
+	if strings.HasPrefix(address, "unix:") {
+		return net.DialTimeout("unix", strings.TrimPrefix(address, "unix:"), timeout)
+	}
+	return net.DialTimeout("tcp", address, timeout)
+}
+
+// deadlineReader extends the read deadline of conn before every read, so that
+// reads only time out if the other end stops sending data.
+type deadlineReader struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (r *deadlineReader) Read(b []byte) (int, error) {
+	r.conn.SetReadDeadline(time.Now().Add(r.timeout))
+	return r.conn.Read(b)
+}
+
+// deadlineWriter extends the write deadline of conn before every write, so
+// that a data block passed on as it arrives only times out if the other end
+// stops reading it, however long the client takes to send it.
+type deadlineWriter struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+func (w *deadlineWriter) Write(b []byte) (int, error) {
+	w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	return w.conn.Write(b)
+}
+
+func handleSCGI(conf *Config, req *Request, route *SCGIRoute) {
+	conn := req.conn
+	pathInfo, _ := matchMount(route.Path, req.path)
+	vars := prepareGatewayVariables(conf, req, strings.TrimSuffix(route.Path, "/"), pathInfo)
+
+	log.Println("Passing request to SCGI backend:", route.Address)
+	backend, err := dialBackend(route.Address, route.connectTimeout())
+	if err != nil {
+		log.Println("Error connecting to SCGI backend:", err.Error())
+		sendResponseHeader(conn, statusServerError, "SCGI backend unavailable")
+		return
+	}
+	defer backend.Close()
+
+	w := &deadlineWriter{backend, route.readTimeout()}
+	if _, err = w.Write(scgiHeaders(vars, req.dataLen)); err == nil {
+		_, err = io.Copy(w, req.data)
+	}
+	if err != nil && req.data.timedOutReading() {
+		sendResponseHeader(conn, statusClientError, "Timed out reading data block")
+		return
+	}
+	if err != nil {
+		log.Println("Error sending request to SCGI backend:", err.Error())
+		sendResponseHeader(conn, statusServerError, "SCGI backend error")
+		return
+	}
+
+	output := bufio.NewReaderSize(&deadlineReader{backend, route.readTimeout()}, maxHeaderLength)
+	header, err := readResponseHeader(output)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		log.Println("Timed out waiting for SCGI backend", route.Address)
+		sendResponseHeader(conn, statusServerError, "SCGI backend timed out")
+		return
+	}
+	if err != nil {
+		log.Println("Unable to parse first line of output from SCGI backend " + route.Address + " as valid Spartan response header: " + err.Error() + ". Line was: " + strings.TrimRight(string(header), "\r\n"))
+		sendResponseHeader(conn, statusServerError, "SCGI backend error")
+		return
+	}
+	log.Println("Returning SCGI output")
+	if _, err = conn.Write(header); err == nil {
+		_, err = io.Copy(conn, output)
+	}
+	if err != nil {
+		log.Println("Error relaying SCGI response:", err.Error())
+	}
+}
+
+// scgiHeaders encodes the request headers as a netstring. CONTENT_LENGTH must
+// come first, and SCGI must be set to 1.
+func scgiHeaders(vars map[string]string, contentLength int) []byte {
+	var headers bytes.Buffer
+	writeHeader := func(key, value string) {
+		headers.WriteString(key)
+		headers.WriteByte(0)
+		headers.WriteString(value)
+		headers.WriteByte(0)
+	}
+	writeHeader("CONTENT_LENGTH", strconv.Itoa(contentLength))
+	writeHeader("SCGI", "1")
+	keys := make([]string, 0, len(vars))
+	for key := range vars {
+		if key != "CONTENT_LENGTH" && key != "SCGI" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		writeHeader(key, vars[key])
+	}
+	return []byte(fmt.Sprintf("%d:%s,", headers.Len(), headers.String()))
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// scgiRequest is a request received by the stand-in backend
+type scgiRequest struct {
+	headers [][2]string // In the order they were sent
+	body    []byte
+}
+
+func (r *scgiRequest) header(key string) string {
+	for _, header := range r.headers {
+		if header[0] == key {
+			return header[1]
+		}
+	}
+	return ""
+}
+
+// startSCGIBackend starts a stand-in SCGI backend on a loopback listener. It
+// reads each request and passes it on to respond, along with the connection
+// to write the response to. Requests are sent to the returned channel.
+func startSCGIBackend(t *testing.T, respond func(*scgiRequest, net.Conn)) (string, <-chan *scgiRequest) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	requests := make(chan *scgiRequest, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			req, err := readSCGIRequest(bufio.NewReader(conn))
+			if err != nil {
+				t.Errorf("backend: %s", err)
+				conn.Close()
+				continue
+			}
+			requests <- req
+			respond(req, conn)
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String(), requests
+}
+
+// readSCGIRequest reads the netstring of headers and the body after it
+func readSCGIRequest(r *bufio.Reader) (*scgiRequest, error) {
+	length, err := r.ReadString(':')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(length[:len(length)-1])
+	if err != nil {
+		return nil, err
+	}
+	netstring := make([]byte, n+1)
+	if _, err := io.ReadFull(r, netstring); err != nil {
+		return nil, err
+	}
+	if netstring[n] != ',' {
+		return nil, io.ErrUnexpectedEOF
+	}
+	req := &scgiRequest{}
+	fields := bytes.Split(netstring[:n], []byte{0})
+	// The last header ends with a NUL too
+	for i := 0; i+1 < len(fields); i += 2 {
+		req.headers = append(req.headers, [2]string{string(fields[i]), string(fields[i+1])})
+	}
+	contentLength, err := strconv.Atoi(req.header("CONTENT_LENGTH"))
+	if err != nil {
+		return nil, err
+	}
+	req.body = make([]byte, contentLength)
+	if _, err := io.ReadFull(r, req.body); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func TestSCGI(t *testing.T) {
+	addr, requests := startSCGIBackend(t, func(req *scgiRequest, conn net.Conn) {
+		conn.Write([]byte("2 text/plain\r\ngot " + string(req.body)))
+	})
+	conf := testConfig(t)
+	conf.SCGI = []SCGIRoute{{Path: "/app/", Address: addr}}
+	if err := conf.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	response := doRequest(t, conf, "localhost /app/some/page?q=1 5", "hello")
+	if want := "2 text/plain\r\ngot hello"; response != want {
+		t.Errorf("got response %q, want %q", response, want)
+	}
+	req := <-requests
+	if len(req.headers) < 2 || req.headers[0] != [2]string{"CONTENT_LENGTH", "5"} || req.headers[1] != [2]string{"SCGI", "1"} {
+		t.Errorf("headers must start with CONTENT_LENGTH=5 and SCGI=1, got %q", req.headers)
+	}
+	for key, want := range map[string]string{
+		"SCRIPT_NAME":    "/app",
+		"PATH_INFO":      "/some/page",
+		"QUERY_STRING":   "q=1",
+		"REQUEST_METHOD": "POST",
+	} {
+		if got := req.header(key); got != want {
+			t.Errorf("got %s=%q, want %q", key, got, want)
+		}
+	}
+	seen := make(map[string]bool)
+	for _, header := range req.headers {
+		if seen[header[0]] {
+			t.Errorf("header %s sent more than once", header[0])
+		}
+		seen[header[0]] = true
+	}
+}
+
+func TestSCGIBackendDown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nothing listens on this address any more
+	addr := listener.Addr().String()
+	listener.Close()
+
+	conf := testConfig(t)
+	conf.SCGI = []SCGIRoute{{Path: "/app", Address: addr, BackendTimeouts: BackendTimeouts{ConnectTimeout: 1}}}
+	if err := conf.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if response := doRequest(t, conf, "localhost /app 0", ""); response != "5 SCGI backend unavailable\r\n" {
+		t.Errorf("got response %q", response)
+	}
+}
+
+func TestSCGIReadTimeout(t *testing.T) {
+	stop := make(chan struct{})
+	defer close(stop)
+	addr, _ := startSCGIBackend(t, func(req *scgiRequest, conn net.Conn) {
+		// Never respond
+		<-stop
+	})
+	conf := testConfig(t)
+	conf.SCGI = []SCGIRoute{{Path: "/app", Address: addr, BackendTimeouts: BackendTimeouts{ReadTimeout: 1}}}
+	if err := conf.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if response := doRequest(t, conf, "localhost /app 0", ""); response != "5 SCGI backend timed out\r\n" {
+		t.Errorf("got response %q", response)
+	}
+}
+
+func TestSCGISlowDataBlock(t *testing.T) {
+	addr, _ := startSCGIBackend(t, func(req *scgiRequest, conn net.Conn) {
+		conn.Write([]byte("2 text/plain\r\ngot " + string(req.body)))
+	})
+	conf := testConfig(t)
+	conf.SCGI = []SCGIRoute{{Path: "/app", Address: addr, BackendTimeouts: BackendTimeouts{ReadTimeout: 1}}}
+	if err := conf.validate(); err != nil {
+		t.Fatal(err)
+	}
+	// The data block takes longer than readTimeout to arrive, but the
+	// backend keeps up with it
+	response := doSlowRequest(t, startServer(t, conf), "localhost /app 10", "helloworld", 1500*time.Millisecond)
+	if want := "2 text/plain\r\ngot helloworld"; response != want {
+		t.Errorf("got response %q, want %q", response, want)
+	}
+}
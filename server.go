@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Server accepts spartan connections and keeps track of the ones in flight so
+// they can be drained when shutting down.
+type Server struct {
+	// conf holds the current *Config. Each connection loads it once when
+	// accepted so a reload does not affect requests already being served.
+	conf atomic.Value
+	// listeners are keyed by their entry in Config.Listen
+	listeners map[string]net.Listener
+	// activated is set when the listeners were passed by systemd socket
+	// activation, in which case they are kept as they are on reload.
+	activated bool
+
+	// ctx is cancelled once the drain timeout is reached, which kills any CGI
+	// process still running.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	conns   map[net.Conn]string // Remote IP, once counted in perIP
+	perIP   map[string]int      // Number of conns from each remote IP
+	closing bool
+	served  int64
+}
+
+func NewServer(conf *Config, listeners map[string]net.Listener) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	srv := &Server{
+		listeners: listeners,
+		ctx:       ctx,
+		cancel:    cancel,
+		conns:     make(map[net.Conn]string),
+		perIP:     make(map[string]int),
+	}
+	srv.conf.Store(conf)
+	return srv
+}
+
+// Config returns the configuration currently in use.
+func (srv *Server) Config() *Config {
+	return srv.conf.Load().(*Config)
+}
+
+// listenAddr binds a listener for an entry of Config.Listen
+func listenAddr(addr string) (net.Listener, error) {
+	network, address, err := parseListenAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.Listen(network, address)
+}
+
+// serveSpartan accepts connections and returns content
+func (srv *Server) serveSpartan(listener net.Listener) {
+	for {
+		// Blocking until request received
+		conn, err := listener.Accept()
+		if err != nil {
+			if srv.isClosing() || !srv.isCurrent(listener) {
+				return
+			}
+			log.Println("Error accepting connection:", err.Error())
+			// Avoid spinning on errors such as running out of file descriptors
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		if !srv.track(conn) {
+			conn.Close()
+			return
+		}
+		conf := srv.Config()
+		go func(conn net.Conn) {
+			defer srv.untrack(conn)
+			client := conn
+			if conf.ProxyProtocol {
+				if client, err = readProxyHeader(conn, conf); err != nil {
+					log.Println("Refusing connection from " + conn.RemoteAddr().String() + ": " + err.Error())
+					conn.Close()
+					return
+				}
+			}
+			log.Println("--> Connection from:", client.RemoteAddr())
+			if reason := srv.throttle(conn, client, conf); reason != "" {
+				logThrottle(remoteIP(client), reason)
+				refuse(client, conf)
+				return
+			}
+			handleConnection(srv.ctx, client, conf)
+		}(conn)
+	}
+}
+
+func (srv *Server) isClosing() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.closing
+}
+
+// isCurrent reports whether listener is still in use, as opposed to one
+// removed by a reload.
+func (srv *Server) isCurrent(listener net.Listener) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for _, l := range srv.listeners {
+		if l == listener {
+			return true
+		}
+	}
+	return false
+}
+
+// track registers an accepted connection. It returns false if the server is
+// already shutting down.
+func (srv *Server) track(conn net.Conn) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.closing {
+		return false
+	}
+	srv.conns[conn] = ""
+	srv.wg.Add(1)
+	atomic.AddInt64(&srv.served, 1)
+	return true
+}
+
+func (srv *Server) untrack(conn net.Conn) {
+	srv.mu.Lock()
+	if ip := srv.conns[conn]; ip != "" {
+		if srv.perIP[ip]--; srv.perIP[ip] == 0 {
+			delete(srv.perIP, ip)
+		}
+	}
+	delete(srv.conns, conn)
+	srv.mu.Unlock()
+	srv.wg.Done()
+}
+
+func (srv *Server) activeConns() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return len(srv.conns)
+}
+
+// Shutdown stops accepting new connections and waits up to timeout for the
+// active ones to finish. Connections and CGI processes still running after
+// that are forcibly closed. A timeout of zero waits forever.
+func (srv *Server) Shutdown(timeout time.Duration) {
+	srv.mu.Lock()
+	srv.closing = true
+	for _, listener := range srv.listeners {
+		listener.Close()
+	}
+	srv.mu.Unlock()
+
+	active := srv.activeConns()
+	if timeout > 0 {
+		log.Printf("Waiting up to %s for %d active connection(s) to finish", timeout, active)
+	} else {
+		log.Printf("Waiting for %d active connection(s) to finish", active)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		srv.wg.Wait()
+		close(done)
+	}()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+	select {
+	case <-done:
+		log.Printf("Shutdown complete: drained %d connection(s), %d served in total",
+			active, atomic.LoadInt64(&srv.served))
+	case <-expired:
+		cgi := atomic.LoadInt64(&cgiRunning)
+		// Kill CGI processes, then close whatever is left
+		srv.cancel()
+		srv.mu.Lock()
+		left := len(srv.conns)
+		for conn := range srv.conns {
+			conn.Close()
+		}
+		srv.mu.Unlock()
+		log.Printf("Shutdown complete: drain timeout reached, closed %d of %d connection(s) and killed %d CGI process(es), %d served in total",
+			left, active, cgi, atomic.LoadInt64(&srv.served))
+	}
+	srv.cancel()
+}
+
+// Reload re-reads the config file at path and swaps it in for new
+// connections, while requests already being served finish with the old one.
+// Listeners for new addresses are bound before those for addresses no longer
+// configured are closed. On error the current config and listeners are kept.
+func (srv *Server) Reload(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	conf, err := LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	applyCLIOverrides(conf)
+	if old := srv.Config(); conf.User != old.User || conf.Group != old.Group {
+		log.Println("Warning: changes to User and Group only take effect after a restart")
+	}
+	if conf.User != "" && conf.userCGIEnabled() && launcher == nil {
+		return errors.New("usercgiEnable can only be turned on together with user after a restart")
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.closing {
+		return errors.New("server is shutting down")
+	}
+	if srv.activated {
+		srv.conf.Store(conf)
+		return nil
+	}
+	wanted := make(map[string]bool)
+	added := make(map[string]net.Listener)
+	for _, addr := range conf.listenAddrs() {
+		wanted[addr] = true
+		if _, ok := srv.listeners[addr]; ok {
+			continue
+		}
+		if _, ok := added[addr]; ok {
+			continue
+		}
+		listener, err := listenAddr(addr)
+		if err != nil {
+			for _, l := range added {
+				l.Close()
+			}
+			return fmt.Errorf("unable to listen on %s: %w", addr, err)
+		}
+		added[addr] = listener
+	}
+
+	srv.conf.Store(conf)
+	for addr, listener := range added {
+		srv.listeners[addr] = listener
+		log.Println("Listening for connections on:", addr)
+		go srv.serveSpartan(listener)
+	}
+	for addr, listener := range srv.listeners {
+		if !wanted[addr] {
+			delete(srv.listeners, addr)
+			listener.Close()
+			log.Println("Stopped listening on:", addr)
+		}
+	}
+	return nil
+}
+
+// waitForSignals reloads the config on SIGHUP, and blocks until SIGINT or
+// SIGTERM is received, then shuts the server down gracefully.
+func waitForSignals(srv *Server, confPath string) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for sig := range sigs {
+		if sig == syscall.SIGHUP {
+			log.Println("Received SIGHUP, reloading config from", confPath)
+			if err := srv.Reload(confPath); err != nil {
+				log.Println("Error reloading config, keeping the current one:", err)
+				continue
+			}
+			log.Println("Config reloaded")
+			continue
+		}
+		signal.Stop(sigs)
+		log.Printf("Received %s, shutting down", sig)
+		srv.Shutdown(time.Duration(srv.Config().DrainTimeout) * time.Second)
+		return
+	}
+}
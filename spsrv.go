@@ -2,31 +2,35 @@ package main
 
 import (
 	"bufio"
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
-	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	flag "github.com/spf13/pflag"
 )
 
 type Request struct {
+	ctx      context.Context
 	conn     io.ReadWriteCloser
 	netConn  *net.Conn
+	host     string // Host as requested
 	vhost    string
 	user     string
 	path     string // Requested path
+	query    string // Query string of the request, without the '?'
 	filePath string // Actual file path that does not include the content dir name
 	dataLen  int
-	data     string
+	data     *dataBlock // Read from the connection as it arrives
 }
 
 const (
@@ -47,31 +51,38 @@ var cliDefaultChar = ","
 var cliDefaultInt = 0
 
 var (
-	hostname = flag.StringP("hostname", "h", cliDefaultChar, "Hostname")
-	port     = flag.IntP("port", "p", cliDefaultInt, "Port to listen to")
-	rootDir  = flag.StringP("dir", "d", cliDefaultChar, "Root content directory")
-	confPath = flag.StringP("config", "c", "/etc/spsrv.conf", "Path to config file")
-	helpFlag = flag.BoolP("help", "?", false, "Get CLI help")
+	hostname    = flag.StringP("hostname", "h", cliDefaultChar, "Hostname")
+	port        = flag.IntP("port", "p", cliDefaultInt, "Port to listen to")
+	rootDir     = flag.StringP("dir", "d", cliDefaultChar, "Root content directory")
+	confPath    = flag.StringP("config", "c", "/etc/spsrv.conf", "Path to config file")
+	listen      = flag.StringSliceP("listen", "l", nil, "Address to listen on, can be given more than once")
+	helpFlag    = flag.BoolP("help", "?", false, "Get CLI help")
 	versionFlag = flag.BoolP("version", "v", false, "View version and exit")
 )
 
 var (
 	appVersion = "unknown version"
-	buildTime = "date unknown"
-	appCommit = "unknown"
+	buildTime  = "date unknown"
+	appCommit  = "unknown"
 )
 
-
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == cgiHelperArg {
+		err := runCGIHelper(os.Args[2:])
+		fmt.Fprintln(os.Stderr, "spsrv: unable to run CGI script:", err)
+		os.Exit(127)
+	}
+
 	// Custom usage function because we don't want the "pflag: help requested" message, and
 	// we don't want to show the default values.
 	flag.Usage = func() {
-		fmt.Println(`Usage: spsrv [ [ -c <path> -h <hostname> -p <port> -d <path> ] | --help | --version ]
+		fmt.Println(`Usage: spsrv [ [ -c <path> -h <hostname> -p <port> -l <address> -d <path> ] | --help | --version ]
 
     -c, --config string     Path to config file
     -d, --dir string        Root content directory
     -h, --hostname string   Hostname
-    -p, --port int          Port to listen to`)
+    -p, --port int          Port to listen to
+    -l, --listen address    Address to listen on, can be given more than once`)
 	}
 	flag.Parse()
 
@@ -85,158 +96,216 @@ func main() {
 		return
 	}
 
-
 	conf, err := LoadConfig(*confPath)
 	if err != nil {
 		fmt.Println("Error loading config")
 		fmt.Println(err.Error())
 		return
 	}
+	applyCLIOverrides(conf)
 
-	// This allows users overriding values in config via the CLI
-	if *hostname != cliDefaultChar {
-		conf.Hostname = *hostname
+	listeners, err := activationListeners()
+	if err != nil {
+		log.Fatalf("Unable to use socket activation: %s", err)
 	}
-	if *port != cliDefaultInt {
-		conf.Port = *port
+	activated := listeners != nil
+	if !activated {
+		listeners = make(map[string]net.Listener)
+		for _, addr := range conf.listenAddrs() {
+			listener, err := listenAddr(addr)
+			if err != nil {
+				log.Fatalf("Unable to listen: %s", err)
+			}
+			listeners[addr] = listener
+		}
 	}
-	if *rootDir != cliDefaultChar {
-		conf.RootDir = *rootDir
+	// User CGI scripts are started from a thread that keeps the right to
+	// switch users
+	if conf.User != "" && conf.userCGIEnabled() {
+		if err := startCGILauncher(); err != nil {
+			log.Fatalf("Unable to start launcher for user CGI scripts: %s", err)
+		}
 	}
-
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", conf.Port))
-	if err != nil {
-		log.Fatalf("Unable to listen: %s", err)
+	// Listeners are bound, so there is no need for root from now on
+	if err := dropPrivileges(conf); err != nil {
+		log.Fatalf("Unable to drop privileges: %s", err)
+	}
+	if launcher != nil {
+		if err := launcher.keepCapabilities(); err != nil {
+			log.Fatalf("Unable to start launcher for user CGI scripts: %s", err)
+		}
 	}
 	log.Println("✨ You are now running on spsrv ✨")
-	log.Printf("Listening for connections on port: %d", conf.Port)
+	if activated {
+		log.Println("Using listeners from systemd socket activation, the port and listen options are ignored")
+	}
 
-	serveSpartan(listener, conf)
+	srv := NewServer(conf, listeners)
+	srv.activated = activated
+	for addr, listener := range listeners {
+		log.Println("Listening for connections on:", addr)
+		go srv.serveSpartan(listener)
+	}
+	waitForSignals(srv, *confPath)
 }
 
-// serveSpartan accepts connections and returns content
-func serveSpartan(listener net.Listener, conf *Config) {
-	for {
-		// Blocking until request received
-		conn, err := listener.Accept()
-		if err != nil {
-			log.Println("Error accepting connection:", err.Error())
-		}
-		log.Println("--> Connection from:", conn.RemoteAddr())
-		go handleConnection(conn, conf)
+// applyCLIOverrides allows users overriding values in config via the CLI. It is
+// also applied when the config is reloaded so they keep taking precedence.
+func applyCLIOverrides(conf *Config) {
+	if *hostname != cliDefaultChar {
+		conf.Hostname = *hostname
+	}
+	if *port != cliDefaultInt {
+		conf.Port = *port
+		// Otherwise the port from the command line would be ignored
+		conf.Listen = nil
+	}
+	if len(*listen) != 0 {
+		conf.Listen = *listen
+	}
+	if *rootDir != cliDefaultChar {
+		conf.RootDir = *rootDir
 	}
 }
 
 // handleConnection handles a request and does the response
-func handleConnection(netConn net.Conn, conf *Config) {
-	conn := io.ReadWriteCloser(netConn)
+func handleConnection(ctx context.Context, netConn net.Conn, conf *Config) {
+	conn := io.ReadWriteCloser(&timeoutConn{netConn, time.Duration(conf.WriteTimeout) * time.Second})
 	// defer conn.Close()
 	defer func() {
 		conn.Close()
 		log.Println("Closed connection")
 	}()
 
-	doneScanningRequest := false
-	// Check the size of the request buffer.
-	s := bufio.NewScanner(conn)
-	s.Split(func(data []byte, atEOF bool) (advance int, token []byte, err error) {
-
-		if atEOF && len(data) == 0 {
-			return 0, nil, nil
-		}
-		if doneScanningRequest {
-			// Return a byte
-			return 1, data[:1], nil
-		}
-		// Read request
-		if i := bytes.IndexByte(data, '\n'); i >= 0 {
-			return i + 1, bytes.TrimRight(data[0:i], "\r"), nil
-		}
-		return 0, nil, nil
-	})
-
-	// Sanity check incoming request URL content.
-	if ok := s.Scan(); !ok {
+	// The request line, and its CRLF, must fit in the buffer
+	reader := bufio.NewReaderSize(netConn, conf.MaxRequestLength+2)
+	netConn.SetReadDeadline(time.Now().Add(time.Duration(conf.RequestTimeout) * time.Second))
+	request, err := readRequestLine(reader)
+	if isTimeout(err) {
+		log.Println("Timed out reading request")
+		sendResponseHeader(conn, statusClientError, "Request timed out")
+		return
+	}
+	if err == errRequestTooLong {
+		log.Println("Request longer than", conf.MaxRequestLength, "bytes")
+		sendResponseHeader(conn, statusClientError, "Request too long")
+		return
+	}
+	if err != nil {
 		sendResponseHeader(conn, statusClientError, "Request not valid")
 		return
 	}
 
 	// Parse request
-	request := s.Text()
-	doneScanningRequest = true
 	log.Println("--> Incoming request: \"" + request + "\"")
-	host, reqPath, dataLen, err := parseRequest(request)
+	if !requestLimiter.allow(remoteIP(netConn), conf.RateLimit, conf.RateBurst) {
+		logThrottle(remoteIP(netConn), fmt.Sprintf("more than %g requests per second", conf.RateLimit))
+		sendResponseHeader(conn, statusServerError, slowDown)
+		return
+	}
+	host, reqPath, query, dataLen, err := parseRequest(request)
 	if err != nil {
 		log.Println("Bad request")
 		sendResponseHeader(conn, statusClientError, "Bad request")
 		return
 	}
-	userSubdomainReq := false
-	if conf.Hostname != "" {
-		if conf.Hostname != host {
-			if conf.UserDirEnable && conf.UserSubdomains && strings.HasSuffix(host, conf.Hostname) {
-				userSubdomainReq = true
-			}
-			if !userSubdomainReq {
-				log.Println("Request host does not match config value Hostname, returning client error.")
-				sendResponseHeader(conn, statusClientError, "No proxying to other hosts!")
-				return
-			}
-		}
+	vhostConf := conf.vhostFor(host)
+	if vhostConf == nil {
+		log.Println("Request host does not match config value Hostname or any vhost, returning client error.")
+		sendResponseHeader(conn, statusClientError, "No proxying to other hosts!")
+		return
+	}
+	if vhostConf != conf {
+		log.Println("Serving request with vhost:", vhostConf.Hostname)
+		conf = vhostConf
 	}
+	userSubdomainReq := conf.Hostname != host && conf.userSubdomainOf(host)
 	if strings.Contains(reqPath, "..") {
 		log.Println("Returning client error (directory traversal)")
 		sendResponseHeader(conn, statusClientError, "Stop it with your directory traversal technique!")
 		return
 	}
-
-	var data string
-	if dataLen != 0 {
-		log.Println("Reading data, length", dataLen)
-		// Read the dataLen amount of data from the data block
-		var newData string
-		for s.Scan() {
-			newData = s.Text()
-			if len(data)+len(newData) == dataLen {
-				data += newData
-				break
-			}
-			if len(data)+len(newData) > dataLen {
-				data += newData[:dataLen-len(data)-1]
-			}
-			data += newData
-		}
+	// Rules for paths are matched against the canonical form, so that
+	// //private/ or /./private/ can't get around the ones for /private/
+	reqPath = cleanRequestPath(reqPath)
+
+	// The data block is not read here but passed on as it arrives, to
+	// whatever ends up handling the request
+	if conf.MaxDataSize > 0 && int64(dataLen) > conf.MaxDataSize {
+		log.Printf("Rejecting data block of length %d, larger than MaxDataSize %d", dataLen, conf.MaxDataSize)
+		sendResponseHeader(conn, statusClientError, "Data block too large")
+		return
 	}
+	netConn.SetReadDeadline(time.Now().Add(time.Duration(conf.DataTimeout) * time.Second))
+	data := &dataBlock{r: io.LimitReader(reader, int64(dataLen))}
 
 	var vhost string
 	if userSubdomainReq {
 		// TODO: Handle extra dots like a.b.host.name?
 		vhost = strings.TrimSuffix(host, "."+conf.Hostname)
 	}
-	req := &Request{vhost: vhost, path: reqPath, netConn: &netConn, conn: conn, data: data, dataLen: dataLen}
+	req := &Request{ctx: ctx, host: host, vhost: vhost, path: reqPath, query: query, netConn: &netConn, conn: conn, data: data, dataLen: dataLen}
+
+	if reason := accessDenied(conf, req, false); reason != "" {
+		denyAccess(req, reason)
+		return
+	}
+
+	if target, rule := conf.redirectFor(req); rule != nil {
+		log.Println("Redirecting", reqPath, "to", target, "by [[redirect]] rule for", rule)
+		sendResponseHeader(conn, statusRedirect, target)
+		return
+	}
+	if route := conf.proxyRouteFor(reqPath); route != nil {
+		handleProxy(req, route)
+		return
+	}
+	// Check for SCGI
+	if route := conf.scgiRouteFor(reqPath); route != nil {
+		handleSCGI(conf, req, route)
+		return
+	}
+	if route := conf.fastCGIRouteFor(reqPath); route != nil {
+		handleFastCGI(conf, req, route)
+		return
+	}
 
 	// Time to fetch the files!
-	path := resolvePath(reqPath, conf, req)
+	path, conf, err := resolvePath(reqPath, conf, req)
+	if err != nil {
+		log.Println("Error reading .spsrv file:", err)
+		sendResponseHeader(conn, statusServerError, "Error in directory config")
+		return
+	}
+	if conf.local != nil {
+		// Check again with the rules of the .spsrv files
+		if reason := accessDenied(conf, req, false); reason != "" {
+			denyAccess(req, reason)
+			return
+		}
+		if target, ok := conf.local.Redirects[reqPath]; ok {
+			log.Println("Redirecting", reqPath, "to", target)
+			sendResponseHeader(conn, statusRedirect, target)
+			return
+		}
+	}
+	if filepath.Base(path) == localConfigName {
+		log.Println("Refusing to serve", path)
+		sendResponseHeader(conn, statusClientError, "Not found")
+		return
+	}
 
 	// Check for CGI
-	for _, cgiPath := range conf.CGIPaths {
-		if strings.HasPrefix(req.filePath, cgiPath) {
-			if req.user != "" && (!conf.UserCGIEnable || !conf.UserDirEnable) {
-				break
-			}
-			if req.user != "" && (req.filePath == "" || req.filePath == "/") {
-				// TODO: Refactor - ATM `path` would contain the current CGI file wanted
-				// But for hitting /~user/, req.filePath is NOT index.gmi
-				req.filePath = "index.gmi"
-			}
-			log.Println("Attempting CGI:", req.filePath)
-
-			ok := handleCGI(conf, req, cgiPath)
-			if ok {
-				return
-			}
-			break // CGI failed. just handle the request as if it's a static file.
+	if len(conf.cgiRules) != 0 && (req.user == "" || conf.UserCGIEnable && conf.UserDirEnable) {
+		if req.user != "" && (req.filePath == "" || req.filePath == "/") {
+			// TODO: Refactor - ATM `path` would contain the current CGI file wanted
+			// But for hitting /~user/, req.filePath is NOT the index file
+			req.filePath = conf.IndexFile
+		}
+		if ok := handleCGI(conf, req); ok {
+			return
 		}
+		// No rule matched or CGI failed. just handle the request as if it's a static file.
 	}
 
 	// Reaching here means it is a static file
@@ -244,25 +313,36 @@ func handleConnection(netConn net.Conn, conf *Config) {
 		log.Printf("Got data block of length %v for request where CGI not found.", dataLen)
 		// Not erroring out here because if file not found, return not found rather
 		// than 'Unexpected input'
+		// Read the data block anyway, as closing the connection with data left
+		// unread could reset it before the client gets the response.
+		if _, err := io.Copy(ioutil.Discard, req.data); err != nil && req.data.timedOutReading() {
+			sendResponseHeader(conn, statusClientError, "Timed out reading data block")
+			return
+		}
 	}
 
-	serveFile(conn, reqPath, path, conf, dataLen != 0)
+	// Links and redirects need the path escaped again
+	serveFile(conn, (&url.URL{Path: reqPath}).EscapedPath(), path, conf, dataLen != 0)
 }
 
 // resolvePath takes in teh request path and returns the cleaned filepath that needs to be fetched.
 // It also handles user directories paths /~user/ and /~user if user directories is enabled in the config.
-func resolvePath(reqPath string, conf *Config, req *Request) (path string) {
+// The config returned has the .spsrv files from the root or user directory down to the
+// requested one applied.
+func resolvePath(reqPath string, conf *Config, req *Request) (path string, local *Config, err error) {
 	var user string
+	rootURL := "/"
 	// Handle user subdomains
 	if req.vhost != "" {
 		user = req.vhost
-		path = reqPath
+		path = strings.TrimPrefix(filepath.Clean(reqPath), "/")
 	} else if conf.UserDirEnable && strings.HasPrefix(reqPath, "/~") {
 		// Handle tildes
 		// Note that user.host.name/~user/ would treat it as a literal folder named /~user/
 		// (hence using `else if`)
 		bits := strings.Split(reqPath, "/")
 		user = bits[1][1:]
+		rootURL = "/~" + user + "/"
 
 		// /~user to /~user/ is somehow able to be handled together with any other /folder to /folder/ redirects
 		// So I won't worry about that nor handle it specifically
@@ -271,21 +351,37 @@ func resolvePath(reqPath string, conf *Config, req *Request) (path string) {
 		path = req.filePath
 	}
 
+	dirRequest := strings.HasSuffix(reqPath, "/")
 	if user != "" {
 		req.filePath = path
-		path = filepath.Join("/home/", user, conf.UserDir, path)
+		root := filepath.Join("/home/", user, conf.UserDir)
+		path = filepath.Join(root, path)
 		req.user = user
 
-		if strings.HasSuffix(reqPath, "/") {
-			path = filepath.Join(path, "index.gmi")
+		dir := req.filePath
+		if !dirRequest {
+			dir = filepath.Dir(dir)
+		}
+		if local, err = conf.withLocalConfig(root, rootURL, dir); err != nil {
+			return
+		}
+		if dirRequest {
+			path = filepath.Join(path, local.IndexFile)
 		}
 		return
 	}
 
 	path = reqPath
-	// TODO: [config] default index file for a directory is index.gmi
-	if strings.HasSuffix(reqPath, "/") || reqPath == "" {
-		path = filepath.Join(reqPath, "index.gmi")
+	dirRequest = dirRequest || reqPath == ""
+	dir := strings.TrimPrefix(filepath.Clean("/"+reqPath), "/")
+	if !dirRequest {
+		dir = filepath.Dir(dir)
+	}
+	if local, err = conf.withLocalConfig(conf.RootDir, rootURL, dir); err != nil {
+		return
+	}
+	if dirRequest {
+		path = filepath.Join(reqPath, local.IndexFile)
 	}
 	req.filePath = filepath.Clean(strings.TrimPrefix(path, "/"))
 	path = filepath.Clean(filepath.Join(conf.RootDir, path))
@@ -305,13 +401,14 @@ func serveFile(conn io.ReadWriteCloser, reqPath, path string, conf *Config, hasD
 
 	// Open the requested resource.
 	var content []byte
+	urlPath, _ := url.PathUnescape(reqPath)
 	log.Printf("Fetching: %s", path)
 	f, err := os.Open(path)
 	if err != nil {
 		// not putting the /folder to /folder/ redirect here because folder can still
 		// be opened without errors
 		// Directory listing
-		if conf.DirlistEnable && strings.HasSuffix(path, "index.gmi") {
+		if conf.DirlistEnable && filepath.Base(path) == conf.IndexFile {
 			if hasData {
 				log.Println("Returning client error due to unexpected data block")
 				sendResponseHeader(conn, statusClientError, "Unexpected input data block received")
@@ -319,8 +416,8 @@ func serveFile(conn io.ReadWriteCloser, reqPath, path string, conf *Config, hasD
 			}
 			fullPath := path
 			if _, err := os.Stat(fullPath); os.IsNotExist(err) {
-				// If and only if the path is index.gmi AND index.gmi does not exist
-				fullPath = strings.TrimSuffix(fullPath, "index.gmi")
+				// If and only if the path is the index file AND it does not exist
+				fullPath = strings.TrimSuffix(fullPath, conf.IndexFile)
 				if _, err := os.Stat(fullPath); err == nil {
 					// If the directly exists
 					log.Println("Generating directory listing:", fullPath)
@@ -330,8 +427,8 @@ func serveFile(conn io.ReadWriteCloser, reqPath, path string, conf *Config, hasD
 						sendResponseHeader(conn, statusServerError, "Error generating directory listing")
 						return
 					}
-					path = strings.TrimSuffix(path, "index.gmi")
-					serveContent(conn, content, path)
+					path = strings.TrimSuffix(path, conf.IndexFile)
+					serveContent(conn, content, urlPath, path, conf)
 					return
 				}
 			}
@@ -351,34 +448,41 @@ func serveFile(conn io.ReadWriteCloser, reqPath, path string, conf *Config, hasD
 		return
 	}
 
-	// Read da file
-	content, err = ioutil.ReadAll(f)
-	if err != nil {
+	info, err := f.Stat()
+	if err == nil && info.IsDir() {
 		// /folder to /folder/ redirect
-		// I wish I could check if err is a "path/to/dir" is a directory error
-		// but I couldn't figure out how, so this check below is the best I
-		// can come up with I guess
-		if _, err := os.Stat(path + "/"); !os.IsNotExist(err) {
-			log.Println("Redirecting", path, "to", reqPath+"/")
-			sendResponseHeader(conn, statusRedirect, reqPath+"/")
-			return
-		}
+		log.Println("Redirecting", path, "to", reqPath+"/")
+		sendResponseHeader(conn, statusRedirect, reqPath+"/")
+		return
+	}
+
+	// Only the start of the file is read for sniffing the MIME type, the rest
+	// is copied to the connection as it is read
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 		log.Println(err)
 		sendResponseHeader(conn, statusServerError, "Resource could not be read")
 		return
 	}
-	serveContent(conn, content, path)
-}
+	head = head[:n]
 
-func serveContent(conn io.ReadWriteCloser, content []byte, path string) {
-	// MIME
-	meta := http.DetectContentType(content)
-	if strings.HasSuffix(path, ".gmi") || strings.HasSuffix(path, "/") {
-		meta = "text/gemini; lang=en; charset=utf-8" // TODO: configure custom meta string
+	log.Println("Serving content:", path)
+	sendResponseHeader(conn, statusSuccess, contentType(conf, urlPath, path, head))
+	sendResponseContent(conn, head)
+	if n == sniffLength {
+		if _, err = io.Copy(conn, f); err != nil {
+			log.Printf("There was an error writing to the connection: %s", err)
+		}
 	}
+}
 
+// http.DetectContentType looks at no more than this many bytes
+const sniffLength = 512
+
+func serveContent(conn io.ReadWriteCloser, content []byte, urlPath, path string, conf *Config) {
 	log.Println("Serving content:", path)
-	sendResponseHeader(conn, statusSuccess, meta)
+	sendResponseHeader(conn, statusSuccess, contentType(conf, urlPath, path, content))
 	sendResponseContent(conn, content)
 
 }
@@ -403,16 +507,42 @@ func sendResponseContent(conn io.ReadWriteCloser, content []byte) {
 	}
 }
 
-func parseRequest(r string) (host, path string, contentLength int, err error) {
+// cleanRequestPath removes repeated slashes and . elements from a request
+// path, and makes it absolute. A trailing slash is kept, as it tells
+// directories apart.
+func cleanRequestPath(reqPath string) string {
+	if reqPath == "" {
+		return ""
+	}
+	clean := filepath.Clean("/" + reqPath)
+	if strings.HasSuffix(reqPath, "/") && clean != "/" {
+		clean += "/"
+	}
+	return clean
+}
+
+// parseRequest splits a request line. The path is unescaped and the query
+// string, if any, is split off it.
+func parseRequest(r string) (host, path, query string, contentLength int, err error) {
 	parts := strings.Split(r, " ")
 	if len(parts) != 3 {
 		err = errors.New("Bad request")
 		return
 	}
 	host, path, contentLengthString := parts[0], parts[1], parts[2]
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path, query = path[:i], path[i+1:]
+	}
+	path, err = url.PathUnescape(path)
+	if err != nil {
+		return
+	}
 	contentLength, err = strconv.Atoi(contentLengthString)
 	if err != nil {
 		return
 	}
+	if contentLength < 0 {
+		err = errors.New("Negative data length")
+	}
 	return
 }
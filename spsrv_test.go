@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// testConfig returns the default config for the hostname localhost, with an
+// empty temporary directory as RootDir
+func testConfig(t *testing.T) *Config {
+	t.Helper()
+	conf := defaultConf.clone()
+	conf.Hostname = "localhost"
+	conf.RootDir = t.TempDir()
+	if err := conf.validate(); err != nil {
+		t.Fatal(err)
+	}
+	return conf
+}
+
+// doRequest has handleConnection serve the request line, followed by data,
+// over a loopback connection, and returns the whole response.
+func doRequest(t *testing.T, conf *Config, request, data string) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		handleConnection(context.Background(), conn, conf)
+	}()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte(request + "\r\n" + data)); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	response, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatalf("reading response to %q: %s", request, err)
+	}
+	<-done
+	return string(response)
+}
+
+// startServer serves connections on a loopback listener with
+// handleConnection, until the test ends, and returns its address.
+func startServer(t *testing.T, conf *Config) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handleConnection(context.Background(), conn, conf)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// doSlowRequest sends the request line and the first half of data to the
+// server at addr, then the rest after pause, and returns the whole response.
+func doSlowRequest(t *testing.T, addr, request, data string, pause time.Duration) string {
+	t.Helper()
+	client, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.Write([]byte(request + "\r\n" + data[:len(data)/2])); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(pause)
+	if _, err := client.Write([]byte(data[len(data)/2:])); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	response, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatalf("reading response to %q: %s", request, err)
+	}
+	return string(response)
+}
+
+// pipeFrom returns both ends of an in-memory connection, with the first one
+// coming from ip
+func pipeFrom(t *testing.T, ip string) (conn, other net.Conn) {
+	t.Helper()
+	conn, other = net.Pipe()
+	t.Cleanup(func() {
+		conn.Close()
+		other.Close()
+	})
+	remote := &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}
+	return &proxiedConn{Conn: conn, r: bufio.NewReader(conn), remote: remote, local: conn.LocalAddr()}, other
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The first file descriptor passed by systemd socket activation
+const listenFdsStart = 3
+
+// activationListeners returns the listeners passed by systemd socket
+// activation, keyed by their socket name. It returns nil if spsrv was not
+// socket activated.
+func activationListeners() (map[string]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		return nil, nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	// These should not be passed down to CGI processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make(map[string]net.Listener)
+	for i := 0; i < nfds; i++ {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+		name := fmt.Sprintf("fd%d", fd)
+		if i < len(names) && names[i] != "" && names[i] != "unknown" {
+			name = names[i]
+		}
+		key := "systemd:" + name
+		if _, ok := listeners[key]; ok {
+			key = fmt.Sprintf("systemd:%s:fd%d", name, fd)
+		}
+
+		f := os.NewFile(uintptr(fd), name)
+		listener, err := net.FileListener(f)
+		// FileListener dups the file descriptor
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("file descriptor %d from socket activation is not a listening socket: %w", fd, err)
+		}
+		listeners[key] = listener
+	}
+	return listeners, nil
+}
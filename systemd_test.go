@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestActivationListenersChild is run by TestActivationListeners in a child
+// process, which gets the sockets as file descriptors 3 and up like it would
+// from systemd.
+func TestActivationListenersChild(t *testing.T) {
+	if os.Getenv("SPSRV_TEST_ACTIVATION") == "" {
+		t.Skip("only run as a child of TestActivationListeners")
+	}
+	// systemd sets this to the pid it started, which is only known here
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	listeners, err := activationListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for key, listener := range listeners {
+		keys = append(keys, key+"="+listener.Addr().String())
+		listener.Close()
+	}
+	sort.Strings(keys)
+	for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if value, ok := os.LookupEnv(name); ok {
+			t.Errorf("%s=%s is still set", name, value)
+		}
+	}
+	os.Stdout.WriteString("keys:" + strings.Join(keys, " ") + "\n")
+}
+
+func TestActivationListeners(t *testing.T) {
+	var files []*os.File
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		f, err := listener.(*net.TCPListener).File()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		files = append(files, f)
+		addrs = append(addrs, listener.Addr().String())
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestActivationListenersChild$", "-test.v")
+	cmd.Env = append(os.Environ(),
+		"SPSRV_TEST_ACTIVATION=1",
+		"LISTEN_FDS=3",
+		"LISTEN_FDNAMES=spartan:spartan:unknown",
+	)
+	cmd.ExtraFiles = files
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("child failed: %s\n%s", err, out)
+	}
+	want := []string{
+		"systemd:fd5=" + addrs[2],
+		"systemd:spartan=" + addrs[0],
+		"systemd:spartan:fd4=" + addrs[1],
+	}
+	sort.Strings(want)
+	if !strings.Contains(string(out), "keys:"+strings.Join(want, " ")+"\n") {
+		t.Errorf("want listeners %v, child printed:\n%s", want, out)
+	}
+}
+
+func TestActivationListenersNotActivated(t *testing.T) {
+	for _, env := range []map[string]string{
+		{},
+		// Meant for another process, such as the parent of spsrv
+		{"LISTEN_PID": strconv.Itoa(os.Getppid()), "LISTEN_FDS": "1"},
+		{"LISTEN_PID": strconv.Itoa(os.Getpid()), "LISTEN_FDS": "0"},
+		{"LISTEN_PID": strconv.Itoa(os.Getpid()), "LISTEN_FDS": "many"},
+	} {
+		for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+			os.Unsetenv(name)
+		}
+		for name, value := range env {
+			os.Setenv(name, value)
+		}
+		listeners, err := activationListeners()
+		if listeners != nil || err != nil {
+			t.Errorf("with %v: got %v, %v, want nil listeners", env, listeners, err)
+		}
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+}